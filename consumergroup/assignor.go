@@ -0,0 +1,309 @@
+package consumergroup
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Member is an instance of the consumer group, as registered in Zookeeper.
+type Member struct {
+	ID      string
+	Rack    string            // The rack or zone the instance runs in, if it registered one.
+	Weight  int               // The share of partitions the instance should get relative to the other members.
+	Version string            // The version of the application running the instance, if it registered one.
+	Labels  map[string]string // The labels the instance registered.
+	Standby bool              // Whether the instance is a hot standby. Standbys are not passed to the Assignor unless they are promoted.
+
+	activeInstances int // The number of active instances the member asked for, if it registered one.
+
+	Hostname  string    // The host the instance runs on.
+	PID       int       // The process ID of the instance.
+	StartTime time.Time // When the instance joined the consumer group.
+	Topics    []string  // The topics the instance subscribed to.
+
+	Claims map[string][]int32 // The partitions the instance has claimed, by topic. Only set by ConsumerGroup.Members.
+}
+
+// Partition is a partition of a topic that is being divided between the members of the
+// consumer group.
+type Partition struct {
+	ID         int32
+	Leader     int32  // The ID of the broker that leads the partition.
+	LeaderRack string // The rack of the leader, if the broker registered one.
+}
+
+// An Assignor divides the partitions of a topic between the members of the consumer
+// group. Every member runs the assignor on its own, so the result must only depend on
+// the arguments. Members are sorted by ID, and partitions by leader and ID. The result
+// maps member IDs to the partitions they should consume; partitions that are left out
+// are not consumed by anyone.
+type Assignor interface {
+	Assign(topic string, members []*Member, partitions []*Partition) map[string][]*Partition
+}
+
+// RangeAssignor gives every member a consecutive range of partitions, sized in proportion
+// to its weight. This is the default assignor.
+type RangeAssignor struct{}
+
+func (RangeAssignor) Assign(topic string, members []*Member, partitions []*Partition) map[string][]*Partition {
+	return dividePartitionsBetweenConsumers(members, partitions)
+}
+
+// RackAwareAssignor gives every member the same number of partitions as the
+// RangeAssignor, but prefers partitions that are led by a broker in the same rack as the
+// member, to reduce the traffic between racks. Racks are read from the broker
+// registrations and from Config.Instance.Rack of the members.
+type RackAwareAssignor struct{}
+
+func (RackAwareAssignor) Assign(topic string, members []*Member, partitions []*Partition) map[string][]*Partition {
+	result := make(map[string][]*Partition)
+	if len(members) == 0 {
+		return result
+	}
+	remaining := quotas(members, len(partitions))
+
+	// First hand out partitions to members in the rack of their leader.
+	var unassigned []*Partition
+	for _, partition := range partitions {
+		best := -1
+		if partition.LeaderRack != "" {
+			for i, member := range members {
+				if member.Rack == partition.LeaderRack && remaining[i] > 0 && (best < 0 || remaining[i] > remaining[best]) {
+					best = i
+				}
+			}
+		}
+
+		if best < 0 {
+			unassigned = append(unassigned, partition)
+			continue
+		}
+		result[members[best].ID] = append(result[members[best].ID], partition)
+		remaining[best]--
+	}
+
+	// Then fill up the members that have not reached their quota yet.
+	for _, partition := range unassigned {
+		best := 0
+		for i := range members {
+			if remaining[i] > remaining[best] {
+				best = i
+			}
+		}
+		result[members[best].ID] = append(result[members[best].ID], partition)
+		remaining[best]--
+	}
+
+	return result
+}
+
+// usesRacks returns whether an assignor may use the racks of the partition leaders.
+// Assignors of other packages are assumed to.
+func usesRacks(assignor Assignor) bool {
+	switch a := assignor.(type) {
+	case RangeAssignor, *RangeAssignor:
+		return false
+	case RuleAssignor:
+		return a.Assignor != nil && usesRacks(a.Assignor)
+	case *RuleAssignor:
+		return a.Assignor != nil && usesRacks(a.Assignor)
+	}
+	return true
+}
+
+// An AssignmentRule restricts which members may consume some partitions.
+type AssignmentRule struct {
+	Topic      string                    // The topic the rule applies to, or "" for all topics.
+	Partitions []int32                   // The partitions the rule applies to, or nil for all partitions.
+	Members    func([]*Member) []*Member // Selects the members that may consume the partitions. It must keep their order. Nil selects all members.
+	Prefer     bool                      // Fall back to all members if none is selected, instead of leaving the partitions unconsumed.
+}
+
+func (rule *AssignmentRule) appliesTo(topic string, partition *Partition) bool {
+	return (rule.Topic == "" || rule.Topic == topic) && (rule.Partitions == nil || slices.Contains(rule.Partitions, partition.ID))
+}
+
+// RuleAssignor restricts or prefers the members that may consume partitions, e.g. based on
+// their labels or version, and divides the partitions between the selected members using
+// another assignor. The first rule that applies to a partition decides which members may
+// consume it. Partitions no rule applies to may be consumed by all members.
+type RuleAssignor struct {
+	Assignor Assignor // Divides the partitions between the selected members. Defaults to RangeAssignor.
+	Rules    []AssignmentRule
+}
+
+func (ra RuleAssignor) Assign(topic string, members []*Member, partitions []*Partition) map[string][]*Partition {
+	assignor := ra.Assignor
+	if assignor == nil {
+		assignor = RangeAssignor{}
+	}
+
+	// Group the partitions by the members that may consume them.
+	var groups []string
+	eligible := make(map[string][]*Member)
+	grouped := make(map[string][]*Partition)
+	for _, partition := range partitions {
+		selected := members
+		for i := range ra.Rules {
+			if rule := &ra.Rules[i]; rule.appliesTo(topic, partition) {
+				if rule.Members != nil {
+					selected = rule.Members(members)
+				}
+				if len(selected) == 0 && rule.Prefer {
+					selected = members
+				}
+				break
+			}
+		}
+		if len(selected) == 0 {
+			continue
+		}
+
+		ids := make([]string, 0, len(selected))
+		for _, member := range selected {
+			ids = append(ids, member.ID)
+		}
+		key := strings.Join(ids, ",")
+		if _, ok := eligible[key]; !ok {
+			groups = append(groups, key)
+			eligible[key] = selected
+		}
+		grouped[key] = append(grouped[key], partition)
+	}
+
+	result := make(map[string][]*Partition)
+	for _, key := range groups {
+		for id, assigned := range assignor.Assign(topic, eligible[key], grouped[key]) {
+			result[id] = append(result[id], assigned...)
+		}
+	}
+	return result
+}
+
+// WithLabel returns a selector for AssignmentRule.Members that selects the members that
+// registered a label with the given value.
+func WithLabel(key, value string) func([]*Member) []*Member {
+	return func(members []*Member) []*Member {
+		var selected []*Member
+		for _, member := range members {
+			if label, ok := member.Labels[key]; ok && label == value {
+				selected = append(selected, member)
+			}
+		}
+		return selected
+	}
+}
+
+// HighestVersion is a selector for AssignmentRule.Members that selects the members that
+// run the highest registered version. Versions are compared by their dot-separated
+// numeric components, e.g. 1.10.0 is higher than 1.9.2.
+func HighestVersion(members []*Member) []*Member {
+	var selected []*Member
+	for _, member := range members {
+		if member.Version == "" {
+			continue
+		}
+		if len(selected) > 0 {
+			cmp := compareVersions(member.Version, selected[0].Version)
+			if cmp < 0 {
+				continue
+			} else if cmp > 0 {
+				selected = selected[:0]
+			}
+		}
+		selected = append(selected, member)
+	}
+	return selected
+}
+
+// compareVersions compares two versions by their dot-separated components, numerically
+// when both components are numbers.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		if aErr == nil && bErr == nil {
+			if an != bn {
+				return an - bn
+			}
+		} else if cmp := strings.Compare(as[i], bs[i]); cmp != 0 {
+			return cmp
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// activeMembers returns the members that partitions should be divided between: all
+// members that are not standbys, and as many standbys as are needed to reach the largest
+// number of active instances any member registered. Standbys are promoted in the order
+// they joined, so that promotions are stable while the members do not change.
+func activeMembers(members []*Member) []*Member {
+	var active, standbys []*Member
+	wanted := 0
+	for _, member := range members {
+		if member.Standby {
+			standbys = append(standbys, member)
+		} else {
+			active = append(active, member)
+		}
+		wanted = max(wanted, member.activeInstances)
+	}
+	if len(standbys) == 0 || len(active) >= wanted {
+		return active
+	}
+
+	sort.SliceStable(standbys, func(i, j int) bool { return standbys[i].StartTime.Before(standbys[j].StartTime) })
+	promoted := make(map[string]bool)
+	for _, member := range standbys[:min(wanted-len(active), len(standbys))] {
+		promoted[member.ID] = true
+	}
+
+	// Keep the members sorted by ID for the assignor.
+	result := make([]*Member, 0, len(active)+len(promoted))
+	for _, member := range members {
+		if !member.Standby || promoted[member.ID] {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+// quotas returns the number of partitions each member should get in proportion to its
+// weight. Partitions that cannot be divided exactly go to the members with the largest
+// remainders, and to the first members when those are equal.
+func quotas(members []*Member, partitions int) []int {
+	total := 0
+	for _, member := range members {
+		total += member.weight()
+	}
+
+	result := make([]int, len(members))
+	remainders := make([]int, len(members))
+	order := make([]int, len(members))
+	left := partitions
+	for i, member := range members {
+		result[i] = partitions * member.weight() / total
+		remainders[i] = partitions * member.weight() % total
+		order[i] = i
+		left -= result[i]
+	}
+
+	sort.SliceStable(order, func(i, j int) bool { return remainders[order[i]] > remainders[order[j]] })
+	for _, i := range order[:left] {
+		result[i]++
+	}
+	return result
+}
+
+// weight returns the weight of the member, treating instances that did not register one
+// as having a weight of 1.
+func (m *Member) weight() int {
+	if m.Weight <= 0 {
+		return 1
+	}
+	return m.Weight
+}
@@ -0,0 +1,91 @@
+package consumergroup
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// racklessTopicReader fails to read the racks of the brokers.
+type racklessTopicReader struct {
+	partitionTopicReader
+	calls int
+}
+
+func (tr *racklessTopicReader) BrokerRacks() (map[int32]string, error) {
+	tr.calls++
+	return nil, errors.New("no racks")
+}
+
+func TestUsesRacks(t *testing.T) {
+	for _, test := range []struct {
+		assignor Assignor
+		expected bool
+	}{
+		{RangeAssignor{}, false},
+		{RackAwareAssignor{}, true},
+		{RuleAssignor{}, false},
+		{RuleAssignor{Assignor: RackAwareAssignor{}}, true},
+		{&RuleAssignor{Assignor: RangeAssignor{}}, false},
+	} {
+		if usesRacks(test.assignor) != test.expected {
+			t.Errorf("Expected usesRacks(%#v) to be %v", test.assignor, test.expected)
+		}
+	}
+}
+
+func TestRackFailureDoesNotCancelRebalance(t *testing.T) {
+	for _, assignor := range []Assignor{RangeAssignor{}, RackAwareAssignor{}} {
+		config := NewConfig()
+		config.Assignor = assignor
+		cg, _ := newMockConsumerGroup("RackConsumerGroup", []string{"Topic"}, nil, config)
+		reader := &racklessTopicReader{}
+		cg.kazoo = reader
+		cg.consumer = &idleConsumer{}
+		cg.consumers = []*Member{{ID: cg.instanceID}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		assigned := newAssignment(cg, 1)
+		cg.wg.Add(1)
+		go cg.topicConsumer(ctx, cancel, "Topic", assigned, cg.messages, cg.errors)
+
+		var partitions []int32
+		for pending := true; pending; time.Sleep(time.Millisecond) {
+			assigned.l.Lock()
+			pending = assigned.pending > 0
+			partitions = assigned.partitions["Topic"]
+			assigned.l.Unlock()
+		}
+
+		if ctx.Err() != nil {
+			t.Errorf("%T: Expected the rebalance to continue without racks", assignor)
+		}
+		if !slices.Equal(partitions, []int32{0}) {
+			t.Errorf("%T: Expected partition 0 to be assigned, got %v", assignor, partitions)
+		}
+		if _, ok := assignor.(RackAwareAssignor); ok != (reader.calls > 0) {
+			t.Errorf("%T: Unexpected number of reads of the racks: %d", assignor, reader.calls)
+		}
+
+		cancel()
+		cg.wg.Wait()
+	}
+}
+
+func TestInstanceWeightDefault(t *testing.T) {
+	config := NewConfig()
+	config.Instance.Weight = 0
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected an unset weight to use the default, got %s", err)
+	}
+	if weight := (&Member{Weight: config.Instance.Weight}).weight(); weight != 1 {
+		t.Errorf("Expected the default weight of 1, got %d", weight)
+	}
+
+	config.Instance.Weight = -1
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a negative weight to be rejected")
+	}
+}
@@ -0,0 +1,101 @@
+package consumergroup
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// A Batch holds consecutive messages of a single partition. Batches never span a
+// rebalance: messages that were not delivered in a batch before this instance stopped
+// consuming the partition are delivered again by the instance that consumes it next.
+type Batch struct {
+	Topic     string
+	Partition int32
+	Messages  []*sarama.ConsumerMessage
+
+	cg *ConsumerGroup
+}
+
+// Commit marks all messages of the batch as processed, so that their offsets are
+// committed.
+func (b *Batch) Commit() error {
+	return b.cg.CommitUpto(b.Messages[len(b.Messages)-1])
+}
+
+// Returns a channel that you can read to obtain batches of messages from Kafka to
+// process. It is nil unless Config.Batches.Enabled is set, in which case the Messages()
+// channel does not receive any messages.
+func (cg *ConsumerGroup) Batches() <-chan *Batch {
+	return cg.batches
+}
+
+// batchBuilder collects the messages of a partition into batches.
+type batchBuilder struct {
+	cg        *ConsumerGroup
+	topic     string
+	partition int32
+
+	messages []*sarama.ConsumerMessage
+	bytes    int
+	timer    *time.Timer
+}
+
+func newBatchBuilder(cg *ConsumerGroup, topic string, partition int32) *batchBuilder {
+	return &batchBuilder{cg: cg, topic: topic, partition: partition}
+}
+
+// fits returns whether a message can be added to the batch without exceeding MaxBytes. A
+// message that is larger on its own fits into an empty batch.
+func (b *batchBuilder) fits(message *sarama.ConsumerMessage) bool {
+	return len(b.messages) == 0 || b.bytes+len(message.Key)+len(message.Value) <= b.cg.config.Batches.MaxBytes
+}
+
+// add adds a message to the batch, and returns whether the batch is full.
+func (b *batchBuilder) add(message *sarama.ConsumerMessage) bool {
+	if len(b.messages) == 0 {
+		b.timer = time.NewTimer(b.cg.config.Batches.MaxWait)
+	}
+	b.messages = append(b.messages, message)
+	b.bytes += len(message.Key) + len(message.Value)
+
+	return len(b.messages) >= b.cg.config.Batches.MaxMessages || b.bytes >= b.cg.config.Batches.MaxBytes
+}
+
+// expired returns a channel that receives when the batch has waited long enough for more
+// messages. It is nil if the batch is empty.
+func (b *batchBuilder) expired() <-chan time.Time {
+	if b == nil || len(b.messages) == 0 {
+		return nil
+	}
+	return b.timer.C
+}
+
+// discard drops the messages that were not delivered, and stops waiting for more.
+func (b *batchBuilder) discard() {
+	if b == nil || len(b.messages) == 0 {
+		return
+	}
+	b.timer.Stop()
+	b.messages, b.bytes = nil, 0
+}
+
+// deliver sends the batch, and returns the offset of its last message. It returns false
+// if the partition consumer stopped before the batch could be delivered.
+func (b *batchBuilder) deliver(ctx context.Context) (int64, bool) {
+	batch := &Batch{Topic: b.topic, Partition: b.partition, Messages: b.messages, cg: b.cg}
+	b.timer.Stop()
+	b.messages, b.bytes = nil, 0
+
+	if !b.cg.breaker.admit(ctx.Done(), nil, batch.Messages[len(batch.Messages)-1]) {
+		return -1, false
+	}
+
+	select {
+	case b.cg.batches <- batch:
+		return batch.Messages[len(batch.Messages)-1].Offset, true
+	case <-ctx.Done():
+		return -1, false
+	}
+}
@@ -0,0 +1,139 @@
+package consumergroup
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestBatchBuilder(t *testing.T) {
+	config := NewConfig()
+	config.Batches.Enabled = true
+	config.Batches.MaxMessages = 2
+	config.Batches.MaxWait = time.Millisecond
+	cg, _ := newMockConsumerGroup("BatchConsumerGroup", []string{"Topic"}, nil, config)
+
+	b := newBatchBuilder(cg, "Topic", 0)
+	if b.expired() != nil {
+		t.Error("Expected an empty batch not to expire")
+	}
+	if b.add(&sarama.ConsumerMessage{Topic: "Topic", Offset: 10}) {
+		t.Error("Expected the batch not to be full after one message")
+	}
+	<-b.expired()
+	if !b.add(&sarama.ConsumerMessage{Topic: "Topic", Offset: 11}) {
+		t.Error("Expected the batch to be full after two messages")
+	}
+
+	if offset, ok := b.deliver(context.Background()); !ok || offset != 11 {
+		t.Fatalf("Expected the batch to be delivered up to offset 11, got %d", offset)
+	}
+	batch := <-cg.Batches()
+	if len(batch.Messages) != 2 || batch.Topic != "Topic" || batch.Partition != 0 {
+		t.Errorf("Unexpected batch: %+v", batch)
+	}
+
+	if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cg.offsetManager.FinalizePartition("Topic", 0, 11, time.Second); err != nil {
+		t.Errorf("Expected the committed batch to be processed, got %v", err)
+	}
+
+	// A batch that cannot be delivered before the partition is released is dropped.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.add(&sarama.ConsumerMessage{Topic: "Topic", Offset: 12})
+	cg.batches = make(chan *Batch)
+	if _, ok := b.deliver(ctx); ok {
+		t.Error("Expected the batch not to be delivered after the partition consumer stopped")
+	}
+}
+
+func TestBatchMaxBytes(t *testing.T) {
+	config := NewConfig()
+	config.Batches.Enabled = true
+	config.Batches.MaxBytes = 10
+	cg, _ := newMockConsumerGroup("BatchConsumerGroup", []string{"Topic"}, nil, config)
+
+	b := newBatchBuilder(cg, "Topic", 0)
+	large := &sarama.ConsumerMessage{Topic: "Topic", Value: make([]byte, 20)}
+	if !b.fits(large) {
+		t.Error("Expected a large message to fit into an empty batch")
+	}
+	if b.add(&sarama.ConsumerMessage{Topic: "Topic", Value: make([]byte, 6)}) {
+		t.Error("Expected the batch not to be full after 6 bytes")
+	}
+	if b.fits(&sarama.ConsumerMessage{Topic: "Topic", Value: make([]byte, 5)}) {
+		t.Error("Expected a message that exceeds MaxBytes not to fit")
+	}
+	if !b.fits(&sarama.ConsumerMessage{Topic: "Topic", Value: make([]byte, 4)}) {
+		t.Error("Expected a message up to MaxBytes to fit")
+	}
+
+	b.discard()
+	if b.expired() != nil || !b.fits(large) {
+		t.Error("Expected the discarded batch to be empty")
+	}
+}
+
+// reconsumingConsumer stops delivering after two messages the first time, and delivers
+// the same messages again when the partition is consumed again.
+type reconsumingConsumer struct {
+	mockSaramaConsumer
+	calls int
+}
+
+func (c *reconsumingConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	c.calls++
+	pc := &boundedPartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage, 3),
+		errors:   make(chan *sarama.ConsumerError),
+	}
+	for o := int64(1); o <= 3; o++ {
+		if c.calls == 1 && o == 3 {
+			close(pc.messages)
+			break
+		}
+		pc.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: o}
+	}
+	return pc, nil
+}
+
+func TestBatchDiscardedWhenConsumptionIsReestablished(t *testing.T) {
+	config := NewConfig()
+	config.Batches.Enabled = true
+	config.Batches.MaxMessages = 3
+	config.Batches.MaxWait = time.Minute
+	cg, _ := newMockConsumerGroup("BatchConsumerGroup", []string{"Topic"}, nil, config)
+	cg.consumer = &reconsumingConsumer{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go cg.partitionConsumer(ctx, "Topic", 0, newAssignment(cg, 1), cg.messages, cg.errors, &wg)
+
+	select {
+	case batch := <-cg.Batches():
+		var offsets []int64
+		for _, message := range batch.Messages {
+			offsets = append(offsets, message.Offset)
+		}
+		if !slices.Equal(offsets, []int64{1, 2, 3}) {
+			t.Errorf("Expected the messages to be batched once, got offsets %v", offsets)
+		}
+		_ = batch.Commit()
+	case <-time.After(5 * time.Second):
+		t.Error("Timeout waiting for a batch")
+	}
+
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,247 @@
+package consumergroup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// partitionEnd returns the offset at which consuming a partition stops with
+// Config.Bounded. The end is determined when the partition is first claimed, and kept
+// for later claims, so that a rebalance does not move it. Registered instances share
+// the ends in Zookeeper, so that all instances of a job stop a partition at the same
+// offset. Other instances never take over each other's partitions, so they only keep
+// the ends they determined themselves.
+func (cg *ConsumerGroup) partitionEnd(topic string, partition int32) (int64, error) {
+	cg.endsMu.Lock()
+	end, ok := cg.ends[topic][partition]
+	cg.endsMu.Unlock()
+	if ok {
+		return end, nil
+	}
+
+	end = -1
+	var err error
+	if cg.registers() {
+		if end, err = cg.group.FetchEndOffset(topic, partition); err != nil {
+			return -1, err
+		}
+	}
+	if end < 0 {
+		if end, err = cg.endOffset(topic, partition); err != nil {
+			return -1, err
+		}
+		if cg.registers() {
+			// Another instance may have stored an end in the meantime, which wins.
+			if end, err = cg.group.StoreEndOffset(topic, partition, end); err != nil {
+				return -1, err
+			}
+		}
+	}
+
+	cg.endsMu.Lock()
+	defer cg.endsMu.Unlock()
+	if cg.ends == nil {
+		cg.ends = make(map[string]map[int32]int64)
+	}
+	if cg.ends[topic] == nil {
+		cg.ends[topic] = make(map[int32]int64)
+	}
+	cg.ends[topic][partition] = end
+	return end, nil
+}
+
+// clearStaleEnds forgets the end offsets that were stored by an earlier run of the job.
+// A run starts when no instance of the group is registered, e.g. because the instances
+// of the earlier run closed or crashed.
+func (cg *ConsumerGroup) clearStaleEnds() error {
+	if !cg.registers() {
+		return nil
+	}
+	instances, err := cg.group.Instances()
+	if err != nil || len(instances) > 0 {
+		return err
+	}
+	return cg.group.ClearEndOffsets()
+}
+
+// endOffset determines the offset at which consuming a partition stops. The message at
+// the end offset is not consumed.
+func (cg *ConsumerGroup) endOffset(topic string, partition int32) (int64, error) {
+	if offset, ok := cg.config.Bounded.EndOffsets[topic][partition]; ok {
+		return offset, nil
+	}
+	if cg.client == nil {
+		return -1, fmt.Errorf("no Kafka client")
+	}
+
+	if !cg.config.Bounded.EndTime.IsZero() {
+		offset, err := cg.client.GetOffset(topic, partition, cg.config.Bounded.EndTime.UnixMilli())
+		if err != nil || offset >= 0 {
+			return offset, err
+		}
+		// No message was produced after the end time.
+	}
+	return cg.client.GetOffset(topic, partition, sarama.OffsetNewest)
+}
+
+// onlyMarkersBefore returns whether the records of a partition from offset up to the end
+// offset are all transaction markers or aborted messages, which the partition consumer
+// never delivers. It fetches the records itself, because the partition consumer does
+// not tell how far it fetched.
+func (cg *ConsumerGroup) onlyMarkersBefore(topic string, partition int32, offset, end int64) (bool, error) {
+	if cg.client == nil || cg.config.Config == nil || !cg.config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		// Transactions need Kafka 0.11.
+		return false, nil
+	}
+	broker, err := cg.client.Leader(topic, partition)
+	if err != nil {
+		return false, err
+	}
+
+	for offset < end {
+		request := &sarama.FetchRequest{
+			MinBytes:  1,
+			MaxBytes:  sarama.MaxResponseSize,
+			Version:   4,
+			Isolation: cg.config.Consumer.IsolationLevel,
+		}
+		request.AddBlock(topic, partition, offset, cg.config.Consumer.Fetch.Default)
+		response, err := broker.Fetch(request)
+		if err != nil {
+			return false, err
+		}
+		block := response.GetBlock(topic, partition)
+		if block == nil {
+			return false, fmt.Errorf("no records of %s/%d in the fetch response", topic, partition)
+		} else if block.Err != sarama.ErrNoError {
+			return false, block.Err
+		}
+
+		next := offset
+		for _, records := range block.RecordsSet {
+			batch := records.RecordBatch
+			if batch == nil || batch.PartialTrailingRecord {
+				// Messages of Kafka before 0.11 are never transaction markers, and the rest of
+				// a partial batch is unknown.
+				return false, nil
+			}
+			if !batch.Control && !cg.aborted(block, batch) {
+				for _, record := range batch.Records {
+					if o := batch.FirstOffset + record.OffsetDelta; o >= offset && o < end {
+						return false, nil
+					}
+				}
+			}
+			next = max(next, batch.LastOffset()+1)
+		}
+		if next == offset {
+			// Nothing was fetched, so the offset is not known to be at the end yet.
+			return false, nil
+		}
+		offset = next
+	}
+	return true, nil
+}
+
+// aborted returns whether a fetched batch of messages belongs to an aborted transaction,
+// and is therefore never delivered.
+func (cg *ConsumerGroup) aborted(block *sarama.FetchResponseBlock, batch *sarama.RecordBatch) bool {
+	if cg.config.Consumer.IsolationLevel != sarama.ReadCommitted || !batch.IsTransactional {
+		return false
+	}
+	for _, txn := range block.AbortedTransactions {
+		if txn.ProducerID == batch.ProducerID && txn.FirstOffset <= batch.LastOffset() {
+			return true
+		}
+	}
+	return false
+}
+
+// startOffset resolves the offset a partition consumer starts at, which may be
+// sarama.OffsetOldest or sarama.OffsetNewest.
+func (cg *ConsumerGroup) startOffset(topic string, partition int32, offset int64) int64 {
+	if offset >= 0 || cg.client == nil {
+		return offset
+	}
+	if resolved, err := cg.client.GetOffset(topic, partition, offset); err == nil {
+		return resolved
+	}
+	return offset
+}
+
+// finishPartition commits the offset of a partition that reached its end, once all its
+// messages have been processed. It returns ErrPartitionFenced if the partition was claimed
+// by another instance, and the error of the context if the partition consumer was stopped
+// before the offset was committed.
+func (cg *ConsumerGroup) finishPartition(ctx context.Context, topic string, partition int32, lastOffset int64, assigned *assignment) error {
+	for failures := 1; ; failures++ {
+		err := cg.offsetManager.FinalizePartition(topic, partition, lastOffset, cg.config.processingTimeout(topic))
+		if err == nil {
+			cg.clearAttempts(topic, partition)
+			break
+		}
+		cg.Logf("%s/%d :: %s\n", topic, partition, err)
+		if err == ErrPartitionFenced {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cg.backoff(failures)):
+		}
+	}
+
+	if cg.scheduler != nil {
+		cg.scheduler.remove(topic, partition)
+	}
+
+	cg.Logf("%s/%d :: Partition consumer finished at offset %d.\n", topic, partition, lastOffset)
+	cg.notify(&PartitionFinished{Topic: topic, Partition: partition, LastOffset: lastOffset})
+	if assigned.finish(topic, partition) {
+		cg.allPartitionsFinished()
+	}
+	return nil
+}
+
+// allPartitionsFinished closes the Finished() channel, but keeps the partitions claimed
+// until the consumer group is closed.
+func (cg *ConsumerGroup) allPartitionsFinished() {
+	cg.Logf("All partitions finished.\n")
+	cg.finishedOnce.Do(func() { close(cg.finished) })
+}
+
+// finish records that a partition reached its end, and returns whether all assigned
+// partitions did.
+func (a *assignment) finish(topic string, partition int32) bool {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if a.finished == nil {
+		a.finished = make(map[string]map[int32]bool)
+	}
+	if a.finished[topic] == nil {
+		a.finished[topic] = make(map[int32]bool)
+	}
+	a.finished[topic][partition] = true
+	return a.allFinished()
+}
+
+// allFinished returns whether every topic has reported its partitions, and all of them
+// reached their end. The caller must hold the lock.
+func (a *assignment) allFinished() bool {
+	if a.pending > 0 {
+		return false
+	}
+	for topic, partitions := range a.partitions {
+		for _, partition := range partitions {
+			if !a.finished[topic][partition] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,327 @@
+package consumergroup
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type boundedPartitionConsumer struct {
+	messages      chan *sarama.ConsumerMessage
+	errors        chan *sarama.ConsumerError
+	highWaterMark int64
+}
+
+func (pc *boundedPartitionConsumer) AsyncClose()                              {}
+func (pc *boundedPartitionConsumer) Close() error                             { return nil }
+func (pc *boundedPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return pc.messages }
+func (pc *boundedPartitionConsumer) Errors() <-chan *sarama.ConsumerError     { return pc.errors }
+func (pc *boundedPartitionConsumer) HighWaterMarkOffset() int64               { return pc.highWaterMark }
+
+type boundedConsumer struct {
+	mockSaramaConsumer
+	partition *boundedPartitionConsumer
+}
+
+func (c *boundedConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	for o := offset; o < 10; o++ {
+		c.partition.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: o}
+	}
+	return c.partition, nil
+}
+
+func TestBoundedConsumptionStopsAtEndOffset(t *testing.T) {
+	config := NewConfig()
+	config.Bounded.Enabled = true
+	config.Bounded.EndOffsets = map[string]map[int32]int64{"Topic": {0: 4}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cg, _ := newMockConsumerGroup("BoundedConsumerGroup", []string{"Topic"}, nil, config)
+	cg.consumer = &boundedConsumer{partition: &boundedPartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage, 10),
+		errors:   make(chan *sarama.ConsumerError),
+	}}
+
+	assigned := newAssignment(cg, 1)
+	assigned.add("Topic", []int32{0})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go cg.partitionConsumer(ctx, "Topic", 0, assigned, cg.messages, cg.errors, &wg)
+
+	for {
+		select {
+		case message := <-cg.messages:
+			if message.Offset >= 4 {
+				t.Fatalf("Expected consumption to stop before offset 4, got %d", message.Offset)
+			}
+			cg.CommitUpto(message)
+			continue
+		case <-cg.Finished():
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected Finished() to be closed once the partition reached its end")
+		}
+		break
+	}
+
+	select {
+	case <-cg.Done():
+		t.Error("Expected Done() to stay open after all partitions finished")
+	default:
+	}
+
+	if err := cg.Err(); err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	select {
+	case message := <-cg.messages:
+		t.Errorf("Expected no more messages, got offset %d", message.Offset)
+	default:
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+// leaderClient returns the same broker as the leader of every partition.
+type leaderClient struct {
+	sarama.Client
+	broker *sarama.Broker
+}
+
+func (c *leaderClient) Leader(topic string, partition int32) (*sarama.Broker, error) {
+	return c.broker, nil
+}
+
+// newFetchBroker starts a mock broker that answers every fetch request with response, and
+// returns a client whose partitions are all led by it.
+func newFetchBroker(t *testing.T, config *Config, response *sarama.FetchResponse) *leaderClient {
+	mb := sarama.NewMockBroker(t, 1)
+	t.Cleanup(mb.Close)
+	mb.SetHandlerByMap(map[string]sarama.MockResponse{"FetchRequest": sarama.NewMockWrapper(response)})
+
+	broker := sarama.NewBroker(mb.Addr())
+	if err := broker.Open(config.Config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return &leaderClient{broker: broker}
+}
+
+// transactionalConsumer delivers the messages before offset 3, which is a transaction
+// marker that is never delivered.
+type transactionalConsumer struct {
+	mockSaramaConsumer
+}
+
+func (c *transactionalConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	pc := &boundedPartitionConsumer{
+		messages:      make(chan *sarama.ConsumerMessage, 3),
+		errors:        make(chan *sarama.ConsumerError),
+		highWaterMark: 4,
+	}
+	for o := offset; o < 3; o++ {
+		pc.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: o}
+	}
+	return pc, nil
+}
+
+func TestBoundedConsumptionFinishesBeforeTransactionMarker(t *testing.T) {
+	config := NewConfig()
+	config.Version = sarama.V0_11_0_0
+	config.Bounded.Enabled = true
+	config.Bounded.EndOffsets = map[string]map[int32]int64{"Topic": {0: 4}}
+	config.Consumer.MaxWaitTime = 10 * time.Millisecond
+
+	response := &sarama.FetchResponse{Version: 4}
+	response.AddControlRecord("Topic", 0, 3, 1, sarama.ControlRecordCommit)
+
+	cg, _ := newMockConsumerGroup("BoundedConsumerGroup", []string{"Topic"}, nil, config)
+	cg.consumer = &transactionalConsumer{}
+	cg.client = newFetchBroker(t, config, response)
+
+	assigned := newAssignment(cg, 1)
+	assigned.add("Topic", []int32{0})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go cg.partitionConsumer(ctx, "Topic", 0, assigned, cg.messages, cg.errors, &wg)
+
+	for {
+		select {
+		case message := <-cg.messages:
+			cg.CommitUpto(message)
+			continue
+		case <-cg.Finished():
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the partition to finish without a message at its last offset")
+		}
+		break
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+// slowConsumer delivers the messages before offset 2, and the messages up to offset 3
+// only after a pause, like a partition consumer that fails over to another broker.
+type slowConsumer struct {
+	mockSaramaConsumer
+	pause time.Duration
+}
+
+func (c *slowConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	pc := &boundedPartitionConsumer{
+		messages:      make(chan *sarama.ConsumerMessage, 4),
+		errors:        make(chan *sarama.ConsumerError),
+		highWaterMark: 10,
+	}
+	for o := offset; o < 2; o++ {
+		pc.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: o}
+	}
+	time.AfterFunc(c.pause, func() {
+		for o := max(offset, 2); o < 4; o++ {
+			pc.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: o}
+		}
+	})
+	return pc, nil
+}
+
+func TestBoundedConsumptionWaitsForDelayedMessages(t *testing.T) {
+	config := NewConfig()
+	config.Version = sarama.V0_11_0_0
+	config.Bounded.Enabled = true
+	config.Bounded.EndOffsets = map[string]map[int32]int64{"Topic": {0: 4}}
+	config.Consumer.MaxWaitTime = 10 * time.Millisecond
+
+	response := &sarama.FetchResponse{Version: 4}
+	response.AddRecordBatch("Topic", 0, nil, sarama.ByteEncoder("message"), 2, 0, false)
+
+	cg, _ := newMockConsumerGroup("BoundedConsumerGroup", []string{"Topic"}, nil, config)
+	cg.consumer = &slowConsumer{pause: 200 * time.Millisecond}
+	cg.client = newFetchBroker(t, config, response)
+
+	assigned := newAssignment(cg, 1)
+	assigned.add("Topic", []int32{0})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go cg.partitionConsumer(ctx, "Topic", 0, assigned, cg.messages, cg.errors, &wg)
+
+	var consumed []int64
+	for {
+		select {
+		case message := <-cg.messages:
+			consumed = append(consumed, message.Offset)
+			cg.CommitUpto(message)
+			continue
+		case <-cg.Finished():
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the partition to finish once it reached its end")
+		}
+		break
+	}
+
+	if len(consumed) == 0 || consumed[len(consumed)-1] != 3 {
+		t.Errorf("Expected the messages up to offset 3 to be consumed before finishing, got %v", consumed)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestBoundedEndsAreSharedBetweenRuns(t *testing.T) {
+	conn := newFakeConn()
+	newBoundedGroup := func(end int64) *ConsumerGroup {
+		config := NewConfig()
+		config.Bounded.Enabled = true
+		config.Bounded.EndOffsets = map[string]map[int32]int64{"Topic": {0: end}}
+		cg, _ := newMockConsumerGroup("BoundedConsumerGroup", []string{"Topic"}, nil, config)
+		cg.group = newZookeeperGroup(conn, "", "BoundedConsumerGroup")
+		return cg
+	}
+
+	a := newBoundedGroup(4)
+	if end, err := a.partitionEnd("Topic", 0); err != nil || end != 4 {
+		t.Fatalf("Expected the first instance to stop at offset 4, got %d, %v", end, err)
+	}
+
+	// Another instance of the same run, that would determine a later end itself.
+	b := newBoundedGroup(8)
+	if err := b.group.(*zookeeperGroup).Instance("instance-a", instanceRegistration{}).Register([]string{"Topic"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.clearStaleEnds(); err != nil {
+		t.Fatal(err)
+	}
+	if end, err := b.partitionEnd("Topic", 0); err != nil || end != 4 {
+		t.Errorf("Expected the end of the first instance to be reused, got %d, %v", end, err)
+	}
+
+	// The next run starts once no instance is registered.
+	if err := b.group.(*zookeeperGroup).Instance("instance-a", instanceRegistration{}).Deregister(); err != nil {
+		t.Fatal(err)
+	}
+	c := newBoundedGroup(8)
+	if err := c.clearStaleEnds(); err != nil {
+		t.Fatal(err)
+	}
+	if end, err := c.partitionEnd("Topic", 0); err != nil || end != 8 {
+		t.Errorf("Expected the next run to determine its own end, got %d, %v", end, err)
+	}
+
+	for _, cg := range []*ConsumerGroup{a, b, c} {
+		_ = cg.offsetManager.Close()
+	}
+}
+
+// countingClient counts the offset lookups.
+type countingClient struct {
+	offsetClient
+	lookups atomic.Int32
+}
+
+func (c *countingClient) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	c.lookups.Add(1)
+	return c.offsetClient.GetOffset(topic, partition, time)
+}
+
+func TestUnboundedStartDoesNotResolveOffset(t *testing.T) {
+	config := NewConfig()
+	cg, _ := newMockConsumerGroup("BoundedConsumerGroup", []string{"Topic"}, nil, config)
+	cg.group = newZookeeperGroup(newFakeConn(), "", "BoundedConsumerGroup")
+	client := &countingClient{offsetClient: offsetClient{oldest: 5, newest: 20}}
+	cg.client = client
+	consumer := &startRecordingConsumer{starts: make(chan int64, 1)}
+	cg.consumer = consumer
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go cg.partitionConsumer(ctx, "Topic", 0, newAssignment(cg, 1), cg.messages, cg.errors, &wg)
+
+	select {
+	case start := <-consumer.starts:
+		if start != config.Offsets.Initial {
+			t.Errorf("Expected to start at the initial offset, got %d", start)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the partition to be consumed")
+	}
+	cancel()
+	wg.Wait()
+	_ = cg.offsetManager.Close()
+
+	if lookups := client.lookups.Load(); lookups != 0 {
+		t.Errorf("Expected no offset lookups without an end offset, got %d", lookups)
+	}
+}
@@ -0,0 +1,211 @@
+package consumergroup
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+)
+
+// BreakerState is the state of the circuit breaker of a consumer group.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // Messages are delivered.
+	BreakerOpen                         // Delivery is paused, because too many messages failed.
+	BreakerHalfOpen                     // A single message is delivered to probe whether processing works again.
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// ReportResult reports whether processing a message succeeded to the circuit breaker; err
+// is nil if it did. Report the result of a batch with its last message. Delivery.Ack and
+// Delivery.Nack report their result themselves. It does nothing unless
+// Config.Breaker.Enabled is set.
+func (cg *ConsumerGroup) ReportResult(message *sarama.ConsumerMessage, err error) {
+	cg.breaker.record(message, err == nil)
+}
+
+// BreakerState returns the current state of the circuit breaker. It is always
+// BreakerClosed unless Config.Breaker.Enabled is set.
+func (cg *ConsumerGroup) BreakerState() BreakerState {
+	if cg.breaker == nil {
+		return BreakerClosed
+	}
+
+	cg.breaker.l.Lock()
+	defer cg.breaker.l.Unlock()
+	return cg.breaker.state
+}
+
+// breaker pauses the delivery of messages of all partitions while processing them fails,
+// as reported with Delivery.Nack or ReportResult. It opens once FailureRate of at least
+// MinResults results within Window failed, and becomes half-open after ProbeInterval to
+// deliver a single probe message, whose result closes or opens it again.
+//
+// The partitions stay claimed, and every partition consumer resumes with the message it
+// was about to deliver when the breaker opened. The scheduler holds its queued messages
+// the same way. Up to ChannelBufferSize messages that were already sent to the channels
+// of the consumer group are still delivered; their results are ignored while the breaker
+// is not closed.
+type breaker struct {
+	cg *ConsumerGroup
+
+	l       sync.Mutex
+	state   BreakerState
+	changed chan struct{} // Closed when the state changes.
+	gen     int           // Incremented when the state changes, to ignore stale probe timers.
+	probing bool
+	probe   *sarama.ConsumerMessage // The message whose result decides the half-open state.
+
+	windowStart         time.Time
+	successes, failures int
+}
+
+func newBreaker(cg *ConsumerGroup) *breaker {
+	if !cg.config.Breaker.Enabled {
+		return nil
+	}
+	return &breaker{cg: cg, changed: make(chan struct{}), windowStart: time.Now()}
+}
+
+// admit waits until message may be delivered, and returns false if stop or removed is
+// closed first. Either may be nil. While the breaker is half-open, only the first message
+// after every ProbeInterval is admitted, as the probe.
+func (b *breaker) admit(stop, removed <-chan struct{}, message *sarama.ConsumerMessage) bool {
+	if b == nil {
+		return true
+	}
+
+	for {
+		b.l.Lock()
+		if b.state == BreakerClosed {
+			b.l.Unlock()
+			return true
+		}
+		if b.state == BreakerHalfOpen && !b.probing {
+			// Probe again if the result of this probe is never reported.
+			b.probing, b.probe = true, message
+			b.probeAfter(b.cg.config.Breaker.ProbeInterval)
+			b.l.Unlock()
+			return true
+		}
+		changed := b.changed
+		b.l.Unlock()
+
+		select {
+		case <-changed:
+		case <-stop:
+			return false
+		case <-removed:
+			return false
+		}
+	}
+}
+
+// record records the result of processing a message.
+func (b *breaker) record(message *sarama.ConsumerMessage, success bool) {
+	if b == nil {
+		return
+	}
+
+	b.l.Lock()
+	var next BreakerState
+	switch b.state {
+	case BreakerOpen:
+		// Results of messages that were delivered before the breaker opened.
+		b.l.Unlock()
+		return
+	case BreakerHalfOpen:
+		if !b.probing || !sameMessage(b.probe, message) {
+			// Results of messages other than the probe, e.g. ones that were queued
+			// before the breaker opened.
+			b.l.Unlock()
+			return
+		}
+		next = BreakerOpen
+		if success {
+			next = BreakerClosed
+		}
+	case BreakerClosed:
+		now := time.Now()
+		if now.Sub(b.windowStart) >= b.cg.config.Breaker.Window {
+			b.windowStart, b.successes, b.failures = now, 0, 0
+		}
+		if success {
+			b.successes++
+		} else {
+			b.failures++
+		}
+
+		results := b.successes + b.failures
+		if results < b.cg.config.Breaker.MinResults || float64(b.failures)/float64(results) < b.cg.config.Breaker.FailureRate {
+			b.l.Unlock()
+			return
+		}
+		next = BreakerOpen
+	}
+	b.setState(next)
+	b.l.Unlock()
+
+	b.report(next)
+}
+
+// probeAfter makes the breaker half-open after delay, unless its state changes first.
+// The caller must hold the lock.
+func (b *breaker) probeAfter(delay time.Duration) {
+	gen := b.gen
+	time.AfterFunc(delay, func() {
+		b.l.Lock()
+		if b.gen != gen {
+			b.l.Unlock()
+			return
+		}
+		b.setState(BreakerHalfOpen)
+		b.l.Unlock()
+
+		b.report(BreakerHalfOpen)
+	})
+}
+
+// setState changes the state, and wakes up the partition consumers that are waiting to
+// be admitted. The caller must hold the lock.
+func (b *breaker) setState(state BreakerState) {
+	b.state = state
+	b.gen++
+	b.probing, b.probe = false, nil
+	b.windowStart, b.successes, b.failures = time.Now(), 0, 0
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+
+	if state == BreakerOpen {
+		b.probeAfter(b.cg.config.Breaker.ProbeInterval)
+	}
+}
+
+// sameMessage returns whether two messages are at the same offset of the same partition.
+func sameMessage(a, b *sarama.ConsumerMessage) bool {
+	return a != nil && b != nil && a.Topic == b.Topic && a.Partition == b.Partition && a.Offset == b.Offset
+}
+
+func (b *breaker) report(state BreakerState) {
+	if state == BreakerOpen {
+		b.cg.Logf("Circuit breaker OPEN: pausing consumption of all partitions!\n")
+	} else {
+		b.cg.Logf("Circuit breaker %s.\n", state)
+	}
+	metrics.GetOrRegisterGauge("consumergroup-breaker-state", b.cg.config.MetricRegistry).Update(int64(state))
+	b.cg.notify(&BreakerStateChanged{State: state})
+}
@@ -0,0 +1,65 @@
+package consumergroup
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestBreakerPausesAndProbes(t *testing.T) {
+	config := NewConfig()
+	config.Notifications.Enabled = true
+	config.Breaker.Enabled = true
+	config.Breaker.MinResults = 2
+	config.Breaker.ProbeInterval = 50 * time.Millisecond
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cg, _ := newMockConsumerGroup("BreakerConsumerGroup", []string{"Topic"}, nil, config)
+	message := func(offset int64) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Topic: "Topic", Partition: 0, Offset: offset}
+	}
+
+	cg.ReportResult(message(1), errors.New("database down"))
+	if cg.BreakerState() != BreakerClosed {
+		t.Fatal("Expected the breaker to stay closed below MinResults")
+	}
+	cg.ReportResult(message(2), errors.New("database down"))
+	if n := (<-cg.Notifications()).(*BreakerStateChanged); n.State != BreakerOpen {
+		t.Fatalf("Expected the breaker to open, got %s", n.State)
+	}
+
+	stop := make(chan struct{})
+	if cg.breaker.admit(stop, nil, message(3)) != true {
+		t.Fatal("Expected the probe to be admitted")
+	}
+	if n := (<-cg.Notifications()).(*BreakerStateChanged); n.State != BreakerHalfOpen {
+		t.Fatalf("Expected the breaker to be half-open, got %s", n.State)
+	}
+
+	admitted := make(chan bool)
+	go func() { admitted <- cg.breaker.admit(stop, nil, message(4)) }()
+	select {
+	case <-admitted:
+		t.Fatal("Expected only a single probe to be admitted")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// A message that was queued before the breaker opened is not the probe.
+	cg.ReportResult(message(2), nil)
+	if cg.BreakerState() != BreakerHalfOpen {
+		t.Fatal("Expected the result of another message than the probe to be ignored")
+	}
+
+	cg.ReportResult(message(3), nil)
+	if !<-admitted {
+		t.Error("Expected delivery to resume once the probe succeeded")
+	}
+	if n := (<-cg.Notifications()).(*BreakerStateChanged); n.State != BreakerClosed {
+		t.Errorf("Expected the breaker to close, got %s", n.State)
+	}
+	close(stop)
+}
@@ -0,0 +1,103 @@
+package consumergroup
+
+import "sync"
+
+// memoryGroup keeps the offsets of an unnamed broadcast instance in memory. No other
+// instance can ever resume from them, so storing them in Zookeeper would only leave
+// them behind whenever the instance exits without closing. The members and owners of
+// the consumer group are still read from Zookeeper.
+type memoryGroup struct {
+	consumerGroupManager
+
+	l       sync.Mutex
+	offsets map[string]map[int32]storedOffset
+}
+
+type storedOffset struct {
+	offset  int64
+	version int32
+}
+
+func newMemoryGroup(group consumerGroupManager) *memoryGroup {
+	return &memoryGroup{consumerGroupManager: group, offsets: make(map[string]map[int32]storedOffset)}
+}
+
+func (g *memoryGroup) Exists() (bool, error) {
+	return true, nil
+}
+
+func (g *memoryGroup) Create() error {
+	return nil
+}
+
+// CommitOffset stores the offset if it still has the given version, as returned by
+// FetchOffsetVersion. The epoch is ignored, as broadcast instances never claim partitions.
+func (g *memoryGroup) CommitOffset(topic string, partition int32, offset int64, epoch int32, version int32) error {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	if g.offsets[topic] == nil {
+		g.offsets[topic] = make(map[int32]storedOffset)
+	}
+	stored, ok := g.offsets[topic][partition]
+	if version >= 0 && (!ok || stored.version != version) {
+		return offsetChanged
+	}
+	if ok {
+		stored.version++
+	}
+	stored.offset = offset
+	g.offsets[topic][partition] = stored
+	return nil
+}
+
+func (g *memoryGroup) FetchOffset(topic string, partition int32) (int64, error) {
+	offset, _, err := g.FetchOffsetVersion(topic, partition)
+	return offset, err
+}
+
+func (g *memoryGroup) FetchOffsetVersion(topic string, partition int32) (int64, int32, error) {
+	g.l.Lock()
+	defer g.l.Unlock()
+
+	stored, ok := g.offsets[topic][partition]
+	if !ok {
+		return -1, -1, nil
+	}
+	return stored.offset, stored.version, nil
+}
+
+func (g *memoryGroup) PartitionEpoch(topic string, partition int32) (int32, error) {
+	return -1, nil
+}
+
+// The attempts and end offsets are only used by instances that register, or with
+// Poison, which Validate rejects for unnamed broadcast instances.
+
+func (g *memoryGroup) RecordAttempt(topic string, partition int32, offset int64) (int, bool, int64, error) {
+	return 1, false, -1, nil
+}
+
+func (g *memoryGroup) AdvanceAttempts(topic string, partition int32, offset int64, located bool) error {
+	return nil
+}
+
+func (g *memoryGroup) RecordReached(topic string, partition int32, offset int64) error {
+	return nil
+}
+
+func (g *memoryGroup) ClearAttempts(topic string, partition int32) error {
+	return nil
+}
+
+func (g *memoryGroup) FetchEndOffset(topic string, partition int32) (int64, error) {
+	return -1, nil
+}
+
+func (g *memoryGroup) StoreEndOffset(topic string, partition int32, offset int64) (int64, error) {
+	return offset, nil
+}
+
+func (g *memoryGroup) ClearEndOffsets() error {
+	return nil
+}
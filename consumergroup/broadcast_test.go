@@ -0,0 +1,82 @@
+package consumergroup
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBroadcastMemoryGroup(t *testing.T) {
+	conn := newFakeConn()
+	group := newMemoryGroup(newZookeeperGroup(conn, "", "BroadcastGroup"))
+
+	if offset, version, err := group.FetchOffsetVersion("Topic", 0); err != nil || offset != -1 || version != -1 {
+		t.Errorf("Expected no stored offset, got %d (version %d, %v)", offset, version, err)
+	}
+	if err := group.CommitOffset("Topic", 0, 10, -1, -1); err != nil {
+		t.Fatal(err)
+	}
+	_, version, _ := group.FetchOffsetVersion("Topic", 0)
+	if err := group.CommitOffset("Topic", 0, 20, -1, version+1); err != offsetChanged {
+		t.Errorf("Expected offsetChanged for an outdated version, got %v", err)
+	}
+	if err := group.CommitOffset("Topic", 0, 20, -1, version); err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ := group.FetchOffset("Topic", 0); offset != 20 {
+		t.Errorf("Expected offset 20, got %d", offset)
+	}
+
+	if exists, _, _ := conn.Exists("/consumers/BroadcastGroup"); exists {
+		t.Error("Expected nothing to be written to Zookeeper")
+	}
+}
+
+func TestBroadcastValidation(t *testing.T) {
+	config := NewConfig()
+	config.Broadcast.Enabled = true
+	config.StaticAssignment = map[string][]int32{"Topic": {0}}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected Broadcast and StaticAssignment to be rejected together")
+	}
+
+	config = NewConfig()
+	config.Broadcast.Enabled = true
+	config.Broadcast.Name = "a/b"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a Broadcast.Name with a / to be rejected")
+	}
+
+	config = NewConfig()
+	config.Broadcast.Enabled = true
+	config.Offsets.ResetOffsets = true
+	if err := config.Validate(); err == nil {
+		t.Error("Expected Broadcast and Offsets.ResetOffsets to be rejected together")
+	}
+
+	config = NewConfig()
+	config.Broadcast.Enabled = true
+	config.Poison.MaxAttempts = 3
+	if err := config.Validate(); err == nil {
+		t.Error("Expected Poison to be rejected for an unnamed broadcast instance")
+	}
+	config.Broadcast.Name = "host1"
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected Poison to be accepted for a named broadcast instance, got %v", err)
+	}
+}
+
+func TestBroadcastRewindOfConsumedPartition(t *testing.T) {
+	config := NewConfig()
+	config.Broadcast.Enabled = true
+	cg, _ := newMockConsumerGroup("BroadcastConsumerGroup", []string{"Topic"}, nil, config)
+
+	// Broadcast instances consume partitions without claiming them.
+	_, abort := context.WithCancelCause(context.Background())
+	cg.addClaim("Topic", 0, &partitionClaim{epoch: -1, abort: abort})
+	if err := cg.RewindOffset("Topic", 0, 5); err != PartitionInUse {
+		t.Errorf("Expected PartitionInUse, got %v", err)
+	}
+	if err := cg.RewindOffset("Topic", 1, 5); err != nil {
+		t.Errorf("Expected a partition that is not consumed to be rewound, got %v", err)
+	}
+}
@@ -2,13 +2,21 @@ package consumergroup
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
 	"github.com/samuel/go-zookeeper/zk"
 	"github.com/wvanbergen/kazoo-go"
 	"golang.org/x/time/rate"
@@ -16,18 +24,151 @@ import (
 
 var (
 	AlreadyClosing = errors.New("The consumer group is already shutting down.")
+	SessionExpired = errors.New("The Zookeeper session of the consumer group instance has expired.")
+
+	// ErrPartitionFenced is reported when an offset could not be committed because the
+	// partition has been claimed by another instance in the meantime. The partition
+	// consumer is stopped without committing or releasing the partition.
+	ErrPartitionFenced = errors.New("The partition has been claimed by another consumer instance.")
+
+	PartitionInUse = errors.New("The partition is being consumed by a consumer instance.")
+	ShadowReadOnly = errors.New("The consumer group instance is a shadow and does not store offsets.")
+
+	ElectionDisabled = errors.New("Leader election is not enabled for the consumer group.")
 )
 
+// FatalError is reported when the consumer group gave up trying to recover from
+// repeated Zookeeper failures. Once it has been reported the consumer group no
+// longer consumes any messages, and the application should Close it.
+type FatalError struct {
+	Failures int   // The number of consecutive failures that were encountered.
+	Err      error // The last error that was encountered.
+}
+
+func (e *FatalError) Error() string {
+	return fmt.Sprintf("consumer group gave up after %d consecutive failures: %s", e.Failures, e.Err)
+}
+
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
 type Config struct {
 	*sarama.Config
 
 	Zookeeper *kazoo.Config
 
 	Offsets struct {
-		Initial           int64         // The initial offset method to use if the consumer has no previously stored offset. Must be either sarama.OffsetOldest (default) or sarama.OffsetNewest.
-		ProcessingTimeout time.Duration // Time to wait for all the offsets for a partition to be processed after stopping to consume from it. Defaults to 1 minute.
-		CommitInterval    time.Duration // The interval between which the processed offsets are commited.
-		ResetOffsets      bool          // Resets the offsets for the consumergroup so that it won't resume from where it left off previously.
+		Initial           int64             // The initial offset method to use if the consumer has no previously stored offset. Must be either sarama.OffsetOldest (default) or sarama.OffsetNewest.
+		ProcessingTimeout time.Duration     // Time to wait for all the offsets for a partition to be processed after stopping to consume from it. Defaults to 1 minute.
+		CommitInterval    time.Duration     // The interval between which the processed offsets are commited.
+		ResetOffsets      bool              // Resets the offsets for the consumergroup so that it won't resume from where it left off previously.
+		Regression        RegressionPolicy  // What to do with commits that would move the stored offset of a partition backwards. Defaults to RegressionAllow. Use RewindOffset for intentional rewinds.
+		OutOfRange        OutOfRangePolicy  // Where to continue consuming when the offset to resume from is not available anymore. Defaults to OutOfRangeInitial.
+		OnOutOfRange      OutOfRangeHandler // Decides where to continue with OutOfRangeCallback.
+	}
+
+	Topics map[string]*TopicConfig // Overrides the configuration for some topics, by topic name.
+
+	Instance struct {
+		Rack    string            // The rack or zone this instance runs in. Registered in Zookeeper for the RackAwareAssignor.
+		Weight  int               // The share of partitions this instance gets relative to the other instances, e.g. 2 for an instance that has twice the capacity. Defaults to 1, which is also used when it is 0.
+		Version string            // The version of the application, registered in Zookeeper for assignment rules. See RuleAssignor.
+		Labels  map[string]string // Labels registered in Zookeeper for assignment rules, e.g. "role": "canary". See RuleAssignor.
+
+		Standby         bool // Whether this instance is a hot standby, which is only assigned partitions when fewer than ActiveInstances other instances are active. Defaults to false.
+		ActiveInstances int  // The number of instances that should consume partitions. Standbys are promoted in the order they joined when fewer instances are active. Required for standbys.
+	}
+
+	Assignor Assignor // Divides the partitions between the instances of the group. Defaults to RangeAssignor.
+
+	Broadcast struct {
+		Enabled bool   // Whether every instance consumes all partitions of the topics, instead of dividing them between the instances. Defaults to false.
+		Name    string // The name the offsets of this instance are stored under, e.g. its host name, so that it resumes from them after a restart. If empty, the offsets are kept in memory only.
+		Initial int64  // The offset to start from when no offset has been stored. Must be either sarama.OffsetOldest or sarama.OffsetNewest (default).
+	}
+
+	// Consumes all partitions from the offsets the group has committed, without committing
+	// offsets, claiming partitions or registering the instance, e.g. to try out a new
+	// version against production traffic.
+	Shadow struct {
+		Enabled bool // Whether this instance is a shadow of the group. Defaults to false.
+	}
+
+	// StaticAssignment makes the instance consume a fixed set of partitions by topic, instead
+	// of dividing the partitions between the registered instances. The instance does not
+	// register itself, but still claims the partitions and commits their offsets. Every
+	// topic that is consumed must have an entry. Defaults to nil.
+	StaticAssignment map[string][]int32
+
+	Batches struct {
+		Enabled     bool          // Whether messages are delivered in batches per partition on the Batches() channel, instead of on the Messages() channel. Cannot be used with ProcessByKey. Defaults to false.
+		MaxMessages int           // The maximum number of messages in a batch. Defaults to 100.
+		MaxBytes    int           // The maximum size of the keys and values of the messages in a batch. A message that is larger on its own is delivered in a batch of its own. Defaults to 1 MiB.
+		MaxWait     time.Duration // The maximum time to wait for a batch to fill up after its first message arrived. Defaults to 1 second.
+	}
+
+	Deliveries struct {
+		Enabled bool // Whether messages are delivered on the Deliveries() channel, where they must be acknowledged, instead of on the Messages() channel. Cannot be used with Batches or ProcessByKey. Defaults to false.
+	}
+
+	Notifications struct {
+		Enabled bool // Whether lifecycle notifications are sent on the Notifications() channel. If enabled, the channel must be read. Defaults to false.
+	}
+
+	Leadership struct {
+		Enabled   bool   // Whether this instance takes part in electing a leader of the consumer group. Defaults to false.
+		OnElected func() // Called when this instance becomes the leader. May be nil.
+		OnRevoked func() // Called when this instance stops being the leader, including when its Zookeeper session is lost. May be nil.
+	}
+
+	Poison struct {
+		MaxAttempts     int    // The number of times consuming a partition may fail from the same offset before the message there is skipped, e.g. because it keeps crashing the application. Defaults to 0, which disables skipping.
+		DeadLetterTopic string // The topic skipped messages are produced to. Producing requires Producer.Return.Successes. If empty, they are only skipped.
+	}
+
+	Scheduler struct {
+		Enabled bool // Whether the messages of all partitions are delivered in turn, so that busy partitions cannot starve others. Defaults to false.
+	}
+
+	// Consumes every partition only up to an end that is determined when the partition is
+	// first claimed by an instance of the job, e.g. for a batch job that consumes
+	// everything up to now. The ends are shared in Zookeeper, and forgotten when the next
+	// job starts without any registered instances. Once all claimed partitions reached
+	// their end and their offsets were committed, Finished() is closed, and the consumer
+	// group should be closed.
+	Bounded struct {
+		Enabled    bool                       // Whether consumption of every partition stops at its end. Defaults to false.
+		EndOffsets map[string]map[int32]int64 // The offsets to stop before, by topic and partition. Other partitions stop at EndTime or their high-water mark.
+		EndTime    time.Time                  // If set, partitions without an end offset stop at the first message produced at or after this time instead of at their high-water mark.
+	}
+
+	// Limits the rate at which messages are delivered, e.g. to protect a downstream system
+	// during a replay. The limits can be changed at runtime with SetGroupThrottle,
+	// SetTopicThrottle and SetPartitionThrottle. Defaults to no limits.
+	Throttle struct {
+		Group     Throttle // Limits the messages of all topics together.
+		Topic     Throttle // Limits the messages of every topic. Overridden by Topics.
+		Partition Throttle // Limits the messages of every partition. Overridden by Topics.
+	}
+
+	Breaker struct {
+		Enabled       bool          // Whether delivery of all partitions pauses while processing messages fails, e.g. because a downstream system is down. Defaults to false.
+		FailureRate   float64       // The share of failed messages within Window that opens the breaker. Defaults to 0.5.
+		MinResults    int           // The number of results within Window needed before the breaker opens. Defaults to 10.
+		Window        time.Duration // The period over which the failure rate is computed. Defaults to 30 seconds.
+		ProbeInterval time.Duration // Time to wait while the breaker is open before a single message is delivered to probe whether processing works again. Defaults to 10 seconds.
+	}
+
+	Retention struct {
+		CheckInterval time.Duration // How often the committed offsets of the consumed partitions are compared with the oldest available offsets. Defaults to 0, which disables the check.
+		Margin        time.Duration // Warn when a committed offset is expected to be removed by retention within this time, at the current produce rate. Defaults to 1 hour.
+	}
+
+	Recovery struct {
+		Backoff     time.Duration // Time to wait before retrying after failing to watch the consumer instances in Zookeeper. Doubles after every consecutive failure. Defaults to 1 second, which is also used when it is 0.
+		MaxBackoff  time.Duration // The maximum time to wait between retries. Defaults to 30 seconds, which is also used when it is 0.
+		MaxFailures int           // The number of consecutive failures after which a FatalError is reported and consumption stops. Defaults to 10. Set to 0 to retry forever.
 	}
 }
 
@@ -38,6 +179,20 @@ func NewConfig() *Config {
 	config.Offsets.Initial = sarama.OffsetOldest
 	config.Offsets.ProcessingTimeout = 60 * time.Second
 	config.Offsets.CommitInterval = 10 * time.Second
+	config.Instance.Weight = 1
+	config.Batches.MaxMessages = 100
+	config.Batches.MaxBytes = 1024 * 1024
+	config.Batches.MaxWait = 1 * time.Second
+	config.Assignor = RangeAssignor{}
+	config.Broadcast.Initial = sarama.OffsetNewest
+	config.Breaker.FailureRate = 0.5
+	config.Breaker.MinResults = 10
+	config.Breaker.Window = 30 * time.Second
+	config.Breaker.ProbeInterval = 10 * time.Second
+	config.Retention.Margin = 1 * time.Hour
+	config.Recovery.Backoff = 1 * time.Second
+	config.Recovery.MaxBackoff = 30 * time.Second
+	config.Recovery.MaxFailures = 10
 
 	return config
 }
@@ -55,6 +210,182 @@ func (cgc *Config) Validate() error {
 		return errors.New("Offsets.Initial should be sarama.OffsetOldest or sarama.OffsetNewest.")
 	}
 
+	if !cgc.Offsets.OutOfRange.valid() {
+		return sarama.ConfigurationError("Offsets.OutOfRange is not a valid policy")
+	}
+
+	if !cgc.Offsets.Regression.valid() {
+		return sarama.ConfigurationError("Offsets.Regression is not a valid policy")
+	}
+
+	for topic, tc := range cgc.Topics {
+		if tc == nil {
+			return sarama.ConfigurationError(fmt.Sprintf("Topics[%s] should not be nil", topic))
+		}
+		if err := tc.validate(topic, cgc.Config); err != nil {
+			return err
+		}
+	}
+
+	if policy, handler := cgc.outOfRangePolicy(""); policy == OutOfRangeCallback && handler == nil {
+		return sarama.ConfigurationError("Offsets.OnOutOfRange should be set for OutOfRangeCallback")
+	}
+	for topic := range cgc.Topics {
+		if policy, handler := cgc.outOfRangePolicy(topic); policy == OutOfRangeCallback && handler == nil {
+			return sarama.ConfigurationError(fmt.Sprintf("Topics[%s].OnOutOfRange should be set for OutOfRangeCallback", topic))
+		}
+	}
+
+	if cgc.Instance.Weight < 0 {
+		return sarama.ConfigurationError("Instance.Weight should be >= 0")
+	}
+
+	if cgc.Instance.ActiveInstances < 0 {
+		return sarama.ConfigurationError("Instance.ActiveInstances should be >= 0")
+	}
+
+	if cgc.Instance.Standby && cgc.Instance.ActiveInstances == 0 {
+		return sarama.ConfigurationError("Instance.ActiveInstances should be set for standby instances")
+	}
+
+	if cgc.Broadcast.Enabled {
+		if cgc.StaticAssignment != nil {
+			return sarama.ConfigurationError("Broadcast and StaticAssignment cannot be used together")
+		}
+		if strings.Contains(cgc.Broadcast.Name, "/") {
+			return sarama.ConfigurationError("Broadcast.Name should not contain a /")
+		}
+		if cgc.Broadcast.Initial != sarama.OffsetOldest && cgc.Broadcast.Initial != sarama.OffsetNewest {
+			return sarama.ConfigurationError("Broadcast.Initial should be sarama.OffsetOldest or sarama.OffsetNewest")
+		}
+		if cgc.Offsets.ResetOffsets {
+			return sarama.ConfigurationError("Broadcast instances cannot reset the offsets of the group")
+		}
+		if cgc.Broadcast.Name == "" && cgc.Poison.MaxAttempts > 0 {
+			return sarama.ConfigurationError("Poison needs a Broadcast.Name to count attempts across restarts")
+		}
+	}
+
+	if cgc.Shadow.Enabled {
+		if cgc.Broadcast.Enabled {
+			return sarama.ConfigurationError("Shadow and Broadcast cannot be used together")
+		}
+		if cgc.Leadership.Enabled {
+			return sarama.ConfigurationError("Shadow instances cannot take part in the leader election")
+		}
+		if cgc.Offsets.ResetOffsets {
+			return sarama.ConfigurationError("Shadow instances cannot reset the offsets of the group")
+		}
+		if cgc.Instance.Standby {
+			return sarama.ConfigurationError("Shadow instances cannot be standby instances")
+		}
+		if cgc.Poison.MaxAttempts > 0 {
+			return sarama.ConfigurationError("Shadow instances cannot skip poison messages")
+		}
+	}
+
+	for topic, partitions := range cgc.StaticAssignment {
+		if len(partitions) == 0 {
+			return sarama.ConfigurationError(fmt.Sprintf("StaticAssignment should list at least one partition of topic %s", topic))
+		}
+		for _, partition := range partitions {
+			if partition < 0 {
+				return sarama.ConfigurationError(fmt.Sprintf("StaticAssignment lists invalid partition %d of topic %s", partition, topic))
+			}
+		}
+	}
+
+	if cgc.Assignor == nil {
+		return sarama.ConfigurationError("Assignor should not be nil")
+	}
+
+	if cgc.Batches.Enabled {
+		if cgc.Batches.MaxMessages < 1 {
+			return sarama.ConfigurationError("Batches.MaxMessages should be >= 1")
+		}
+		if cgc.Batches.MaxBytes < 1 {
+			return sarama.ConfigurationError("Batches.MaxBytes should be >= 1")
+		}
+		if cgc.Batches.MaxWait <= 0 {
+			return sarama.ConfigurationError("Batches.MaxWait should have a duration > 0")
+		}
+	}
+
+	if cgc.Deliveries.Enabled && cgc.Batches.Enabled {
+		return sarama.ConfigurationError("Deliveries and Batches cannot be used together")
+	}
+
+	for topic, offsets := range cgc.Bounded.EndOffsets {
+		for partition, offset := range offsets {
+			if offset < 0 {
+				return sarama.ConfigurationError(fmt.Sprintf("Bounded.EndOffsets[%s][%d] should be >= 0", topic, partition))
+			}
+		}
+	}
+
+	if cgc.Scheduler.Enabled && cgc.Batches.Enabled {
+		return sarama.ConfigurationError("Scheduler and Batches cannot be used together")
+	}
+
+	if cgc.Poison.MaxAttempts < 0 {
+		return sarama.ConfigurationError("Poison.MaxAttempts should be >= 0")
+	}
+
+	if cgc.Poison.DeadLetterTopic != "" && cgc.Config != nil && !cgc.Producer.Return.Successes {
+		return sarama.ConfigurationError("Producer.Return.Successes should be true to produce to Poison.DeadLetterTopic")
+	}
+
+	if err := cgc.Throttle.Group.validate("Throttle.Group"); err != nil {
+		return err
+	}
+
+	if err := cgc.Throttle.Topic.validate("Throttle.Topic"); err != nil {
+		return err
+	}
+
+	if err := cgc.Throttle.Partition.validate("Throttle.Partition"); err != nil {
+		return err
+	}
+
+	if cgc.Breaker.Enabled {
+		if cgc.Breaker.FailureRate <= 0 || cgc.Breaker.FailureRate > 1 {
+			return sarama.ConfigurationError("Breaker.FailureRate should be > 0 and <= 1")
+		}
+		if cgc.Breaker.MinResults <= 0 {
+			return sarama.ConfigurationError("Breaker.MinResults should be > 0")
+		}
+		if cgc.Breaker.Window <= 0 {
+			return sarama.ConfigurationError("Breaker.Window should have a duration > 0")
+		}
+		if cgc.Breaker.ProbeInterval <= 0 {
+			return sarama.ConfigurationError("Breaker.ProbeInterval should have a duration > 0")
+		}
+	}
+
+	if cgc.Retention.CheckInterval < 0 {
+		return sarama.ConfigurationError("Retention.CheckInterval should have a duration >= 0")
+	}
+
+	if cgc.Retention.CheckInterval > 0 && cgc.Retention.Margin <= 0 {
+		return sarama.ConfigurationError("Retention.Margin should have a duration > 0")
+	}
+
+	if cgc.Recovery.Backoff < 0 {
+		return sarama.ConfigurationError("Recovery.Backoff should have a duration >= 0")
+	}
+
+	if cgc.Recovery.MaxBackoff < 0 {
+		return sarama.ConfigurationError("Recovery.MaxBackoff should have a duration >= 0")
+	}
+
+	if backoff, maxBackoff := cgc.recoveryBackoff(); maxBackoff < backoff {
+		return sarama.ConfigurationError("Recovery.MaxBackoff should be >= Recovery.Backoff")
+	}
+
+	if cgc.Recovery.MaxFailures < 0 {
+		return sarama.ConfigurationError("Recovery.MaxFailures should be >= 0")
+	}
+
 	if cgc.Config != nil {
 		if err := cgc.Config.Validate(); err != nil {
 			return err
@@ -69,29 +400,43 @@ func newDefaultLimiter() *rate.Limiter {
 }
 
 type consumerGroupManager interface {
-	CommitOffset(string, int32, int64) error
+	CommitOffset(topic string, partition int32, offset int64, epoch int32, version int32) error
 	Create() error
 	Exists() (bool, error)
 	FetchOffset(string, int32) (int64, error)
-	WatchInstances() (kazoo.ConsumergroupInstanceList, <-chan zk.Event, error)
+	FetchOffsetVersion(topic string, partition int32) (int64, int32, error)
+	PartitionEpoch(topic string, partition int32) (int32, error)
+	RecordAttempt(topic string, partition int32, offset int64) (int, bool, int64, error)
+	AdvanceAttempts(topic string, partition int32, offset int64, located bool) error
+	RecordReached(topic string, partition int32, offset int64) error
+	ClearAttempts(topic string, partition int32) error
+	FetchEndOffset(topic string, partition int32) (int64, error)
+	StoreEndOffset(topic string, partition int32, offset int64) (int64, error)
+	ClearEndOffsets() error
+	Instances() ([]*Member, error)
+	PartitionOwners() (map[string]map[int32]string, error)
+	WatchInstances() ([]*Member, <-chan zk.Event, error)
 }
 
 type consumerGroupInstanceManager interface {
 	Deregister() error
 	Register(topics []string) error
 	Registered() (bool, error)
-	ClaimPartition(topic string, partition int32) error
+	ClaimPartition(topic string, partition int32) (int32, error)
 	ReleasePartition(topic string, partition int32) error
 }
 
 type zookeeperTopicReader interface {
+	BrokerRacks() (map[int32]string, error)
 	Close() error
 	RetrievePartitionLeaders(partitions kazoo.PartitionList) (partitionLeaders, error)
 	TopicPartitions(topic string) (kazoo.PartitionList, error)
 }
 
 type zookeeperClient struct {
-	zk *kazoo.Kazoo
+	zk     *kazoo.Kazoo
+	conn   zookeeperConn
+	chroot string
 }
 
 func (cl *zookeeperClient) Close() error {
@@ -110,36 +455,112 @@ func (cl *zookeeperClient) RetrievePartitionLeaders(partitions kazoo.PartitionLi
 			return nil, err
 		}
 
-		pl := partitionLeader{id: partition.ID, leader: leader, partition: partition}
-		pls = append(pls, pl)
+		pls = append(pls, &Partition{ID: partition.ID, Leader: leader})
 	}
 
 	return pls, nil
 }
 
+// BrokerRacks returns the racks of the brokers that registered one.
+func (cl *zookeeperClient) BrokerRacks() (map[int32]string, error) {
+	root := fmt.Sprintf("%s/brokers/ids", cl.chroot)
+	children, _, err := cl.conn.Children(root)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[int32]string)
+	for _, child := range children {
+		brokerID, err := strconv.ParseInt(child, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		value, _, err := cl.conn.Get(path.Join(root, child))
+		if err == zk.ErrNoNode {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var broker struct {
+			Rack string `json:"rack"`
+		}
+		if err := json.Unmarshal(value, &broker); err != nil {
+			return nil, err
+		}
+		if broker.Rack != "" {
+			result[int32(brokerID)] = broker.Rack
+		}
+	}
+
+	return result, nil
+}
+
+// partitionClaim is a partition that is currently claimed by this instance.
+type partitionClaim struct {
+	epoch int32
+	abort context.CancelCauseFunc
+}
+
 // The ConsumerGroup type holds all the information for a consumer that is part
 // of a consumer group. Call JoinConsumerGroup to start a consumer.
 type ConsumerGroup struct {
 	config *Config
 
-	consumer   sarama.Consumer
-	kazoo      zookeeperTopicReader
-	group      consumerGroupManager
-	groupName  string
-	instance   consumerGroupInstanceManager
-	instanceID string
+	client         sarama.Client
+	consumer       sarama.Consumer
+	fetchConsumers map[string]*fetchConsumer
+	conn           *zk.Conn
+	kazoo          zookeeperTopicReader
+	group          consumerGroupManager
+	groupName      string
+	instance       consumerGroupInstanceManager
+	instanceID     string
 
 	mu             sync.Mutex
 	wg             sync.WaitGroup
 	singleShutdown sync.Once
 
-	messages chan *sarama.ConsumerMessage
-	errors   chan error
-	stopper  chan struct{}
+	messages   chan *sarama.ConsumerMessage
+	batches    chan *Batch
+	deliveries *deliveries
+	breaker    *breaker
+	throttles  *throttles
+	scheduler  *scheduler
+	errors     chan error
+	stopper    chan struct{}
+
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+
+	finished     chan struct{}
+	finishedOnce sync.Once
+	endsMu       sync.Mutex
+	ends         map[string]map[int32]int64
 
-	consumers kazoo.ConsumergroupInstanceList
+	sessionEvents  chan SessionEvent
+	sessionExpired chan struct{}
+
+	notifications       chan Notification
+	notificationsMu     sync.RWMutex
+	notificationsClosed bool
+
+	election       leaderElection
+	electionEvents chan zk.Event
+	leading        atomic.Bool
+	background     sync.WaitGroup
+
+	consumers []*Member
+
+	claimsMu sync.Mutex
+	claims   map[string]map[int32]*partitionClaim
 
 	offsetManager OffsetManager
+
+	deadLettersMu sync.Mutex
+	deadLetters   sarama.SyncProducer
 }
 
 func DefaultConsumerGroup(name string, topics []string, zookeeper []string, config *Config) (cg *ConsumerGroup, err error) {
@@ -153,74 +574,203 @@ func DefaultConsumerGroup(name string, topics []string, zookeeper []string, conf
 		kz.Close()
 		return
 	}
-	group := kz.Consumergroup(name)
 
 	if config.Offsets.ResetOffsets {
-		err = group.ResetOffsets()
+		err = kz.Consumergroup(name).ResetOffsets()
 		if err != nil {
 			kz.Close()
 			return
 		}
 	}
 
+	// The registration and the partition claims are ephemeral nodes that live as long as
+	// the session of this connection, so we keep our own connection to be able to tell
+	// when that session expires.
+	var conn *zk.Conn
+	var sessionEvents <-chan zk.Event
+	if conn, sessionEvents, err = zk.Connect(zookeeper, config.Zookeeper.Timeout, func(c *zk.Conn) {
+		if config.Zookeeper.Logger != nil {
+			c.SetLogger(config.Zookeeper.Logger)
+		}
+	}); err != nil {
+		kz.Close()
+		return
+	}
+	group := newZookeeperGroup(conn, config.Zookeeper.Chroot, name)
+	hostname, hostnameErr := os.Hostname()
+	if hostnameErr != nil {
+		sarama.Logger.Printf("[%s] FAILED to get the hostname to register: %s\n", name, hostnameErr)
+	}
+	registration := instanceRegistration{
+		Rack:            config.Instance.Rack,
+		Weight:          config.Instance.Weight,
+		InstanceVersion: config.Instance.Version,
+		Labels:          config.Instance.Labels,
+		Standby:         config.Instance.Standby,
+		ActiveInstances: config.Instance.ActiveInstances,
+		Hostname:        hostname,
+		PID:             os.Getpid(),
+		StartTime:       time.Now().Unix(),
+	}
+
 	id, err := generateConsumerInstanceID()
 	if err != nil {
+		conn.Close()
 		kz.Close()
 		return
 	}
-	instance := group.Instance(id)
 
-	var consumer sarama.Consumer
-	if consumer, err = sarama.NewConsumer(brokers, config.Config); err != nil {
+	// Broadcast instances keep their offsets apart from the rest of the group, and
+	// unnamed ones only in memory, as no other instance can resume from them.
+	var offsets consumerGroupManager = group
+	if config.Broadcast.Enabled && config.Broadcast.Name == "" {
+		offsets = newMemoryGroup(group)
+	} else if config.Broadcast.Enabled {
+		group = newZookeeperGroup(conn, config.Zookeeper.Chroot, name+"/broadcast/"+config.Broadcast.Name)
+		offsets = group
+	}
+	instance := group.Instance(id, registration)
+
+	var client sarama.Client
+	if client, err = sarama.NewClient(brokers, config.Config); err != nil {
+		conn.Close()
 		kz.Close()
 		return
 	}
 
-	cg = &ConsumerGroup{
-		config:   config,
-		consumer: consumer,
+	var consumer sarama.Consumer
+	if consumer, err = sarama.NewConsumerFromClient(client); err != nil {
+		_ = client.Close()
+		conn.Close()
+		kz.Close()
+		return
+	}
 
-		kazoo:      &zookeeperClient{zk: kz},
-		group:      group,
-		groupName:  name,
-		instance:   instance,
-		instanceID: instance.ID,
+	var fetchConsumers map[string]*fetchConsumer
+	if fetchConsumers, err = newFetchConsumers(brokers, topics, config); err != nil {
+		_ = consumer.Close()
+		_ = client.Close()
+		conn.Close()
+		kz.Close()
+		return
+	}
 
-		messages: make(chan *sarama.ConsumerMessage, config.ChannelBufferSize),
-		errors:   make(chan error, config.ChannelBufferSize),
-		stopper:  make(chan struct{}),
+	cg = newConsumerGroup(name, config)
+	cg.client = client
+	cg.consumer = consumer
+	cg.conn = conn
+	cg.fetchConsumers = fetchConsumers
+	cg.kazoo = &zookeeperClient{zk: kz, conn: conn, chroot: config.Zookeeper.Chroot}
+	cg.group = offsets
+	cg.instance = instance
+	cg.instanceID = instance.id
+
+	if config.Leadership.Enabled {
+		cg.election = newZookeeperGroup(conn, config.Zookeeper.Chroot, name)
+		cg.electionEvents = make(chan zk.Event, config.ChannelBufferSize)
 	}
 
 	// Register consumer group
 	if exists, err := cg.group.Exists(); err != nil {
 		cg.Logf("FAILED to check for existence of consumergroup: %s!\n", err)
+		_ = closeFetchConsumers(fetchConsumers)
 		_ = consumer.Close()
+		_ = client.Close()
+		conn.Close()
 		_ = kz.Close()
 		return nil, err
-	} else if !exists {
+	} else if !exists && !config.Shadow.Enabled {
 		cg.Logf("Consumergroup `%s` does not yet exists, creating...\n", cg.groupName)
 		if err := cg.group.Create(); err != nil {
 			cg.Logf("FAILED to create consumergroup in Zookeeper: %s!\n", err)
+			_ = closeFetchConsumers(fetchConsumers)
+			_ = consumer.Close()
+			_ = client.Close()
+			conn.Close()
+			_ = kz.Close()
+			return nil, err
+		}
+	}
+
+	if config.Bounded.Enabled {
+		if err := cg.clearStaleEnds(); err != nil {
+			cg.Logf("FAILED to clear the end offsets of an earlier run: %s!\n", err)
+			_ = closeFetchConsumers(fetchConsumers)
 			_ = consumer.Close()
+			_ = client.Close()
+			conn.Close()
 			_ = kz.Close()
 			return nil, err
 		}
 	}
 
 	// Register itself with zookeeper
-	if err := cg.instance.Register(topics); err != nil {
-		cg.Logf("FAILED to register consumer instance: %s!\n", err)
-		return nil, err
+	if cg.registers() {
+		if err := cg.instance.Register(topics); err != nil {
+			cg.Logf("FAILED to register consumer instance: %s!\n", err)
+			_ = closeFetchConsumers(fetchConsumers)
+			_ = consumer.Close()
+			_ = client.Close()
+			conn.Close()
+			_ = kz.Close()
+			return nil, err
+		}
+		cg.Logf("Consumer instance registered (%s).", cg.instanceID)
 	}
 
-	cg.Logf("Consumer instance registered (%s).", cg.instanceID)
+	go cg.watchSession(sessionEvents)
 
-	offsetConfig := OffsetManagerConfig{CommitInterval: config.Offsets.CommitInterval}
-	cg.offsetManager = NewZookeeperOffsetManager(cg, &offsetConfig)
+	cg.startOffsetManager()
 
 	return cg, nil
 }
 
+// newConsumerGroup returns a consumer group with the channels and the components its
+// configuration enables. The constructor connects it to Kafka and Zookeeper, and then
+// starts its offset manager.
+func newConsumerGroup(name string, config *Config) *ConsumerGroup {
+	cg := &ConsumerGroup{
+		config:    config,
+		groupName: name,
+
+		messages: make(chan *sarama.ConsumerMessage, messagesBufferSize(config)),
+		errors:   make(chan error, config.ChannelBufferSize),
+		stopper:  make(chan struct{}),
+		done:     make(chan struct{}),
+
+		sessionEvents:  make(chan SessionEvent, config.ChannelBufferSize),
+		sessionExpired: make(chan struct{}, 1),
+	}
+
+	if config.Notifications.Enabled {
+		cg.notifications = make(chan Notification, config.ChannelBufferSize)
+	}
+
+	if config.Batches.Enabled {
+		cg.batches = make(chan *Batch, config.ChannelBufferSize)
+	}
+
+	if config.Deliveries.Enabled {
+		cg.deliveries = newDeliveries(cg)
+	}
+
+	if config.Bounded.Enabled {
+		cg.finished = make(chan struct{})
+	}
+
+	cg.breaker = newBreaker(cg)
+	cg.throttles = newThrottles(config)
+	cg.scheduler = newScheduler(cg)
+
+	return cg
+}
+
+// startOffsetManager starts committing the processed offsets of the consumer group.
+func (cg *ConsumerGroup) startOffsetManager() {
+	offsetConfig := OffsetManagerConfig{CommitInterval: cg.config.Offsets.CommitInterval, Regression: cg.config.Offsets.Regression, ReadOnly: cg.config.Shadow.Enabled}
+	cg.offsetManager = NewZookeeperOffsetManager(cg, &offsetConfig)
+}
+
 // Connects to a consumer group, using Zookeeper for auto-discovery
 func JoinConsumerGroup(name string, topics []string, zookeeper []string, config *Config, cgConstructor ...func(string, []string, []string, *Config) (cg *ConsumerGroup, err error)) (cg *ConsumerGroup, err error) {
 	if name == "" {
@@ -245,6 +795,14 @@ func JoinConsumerGroup(name string, topics []string, zookeeper []string, config
 		return
 	}
 
+	if config.StaticAssignment != nil {
+		for _, topic := range topics {
+			if _, ok := config.StaticAssignment[topic]; !ok {
+				return nil, sarama.ConfigurationError(fmt.Sprintf("StaticAssignment has no partitions for topic %s", topic))
+			}
+		}
+	}
+
 	switch len(cgConstructor) {
 	case 0:
 		cg, err = DefaultConsumerGroup(name, topics, zookeeper, config)
@@ -260,6 +818,25 @@ func JoinConsumerGroup(name string, topics []string, zookeeper []string, config
 		return nil, errors.New("more than one cgConstructor is not supported")
 	}
 
+	if cg.deliveries != nil {
+		go cg.deliveries.run()
+	}
+
+	if cg.scheduler != nil {
+		cg.background.Add(1)
+		go cg.scheduler.run()
+	}
+
+	if cg.election != nil {
+		cg.background.Add(1)
+		go cg.runElection()
+	}
+
+	if config.Retention.CheckInterval > 0 && cg.client != nil {
+		cg.background.Add(1)
+		go cg.watchRetention()
+	}
+
 	go cg.topicListConsumer(topics)
 
 	return
@@ -275,6 +852,67 @@ func (cg *ConsumerGroup) Errors() <-chan error {
 	return cg.errors
 }
 
+// SessionState is the state of the Zookeeper session that holds the registration and the
+// partition claims of an instance.
+type SessionState int
+
+const (
+	SessionConnected    SessionState = iota // Connected to Zookeeper with a valid session.
+	SessionDisconnected                     // The connection was lost. The session and the claims are kept if it is restored before the session times out.
+	SessionLost                             // The session expired. All partitions are abandoned, and the instance registers again.
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionConnected:
+		return "connected"
+	case SessionDisconnected:
+		return "disconnected"
+	case SessionLost:
+		return "lost"
+	}
+	return "unknown"
+}
+
+// A SessionEvent reports a change of the state of the Zookeeper session.
+type SessionEvent struct {
+	State  SessionState
+	Server string // The Zookeeper server that was connected to, for SessionConnected.
+}
+
+// SessionEvents returns a channel that receives the state changes of the Zookeeper
+// session that holds this instance's registration and partition claims. When the
+// session expires, all partitions are released without committing their offsets and
+// the instance re-registers and rebalances. The channel has a buffer of
+// ChannelBufferSize events, and events that do not fit because the channel is not read
+// are dropped, so that they never hold up the consumer group. The channel is closed
+// when the consumer group is closed.
+func (cg *ConsumerGroup) SessionEvents() <-chan SessionEvent {
+	return cg.sessionEvents
+}
+
+// Done returns a channel that is closed when the consumer group stops consuming,
+// either because Close was called, or because it failed permanently. Use Err to find
+// out why.
+func (cg *ConsumerGroup) Done() <-chan struct{} {
+	return cg.done
+}
+
+// Finished returns a channel that is closed once all claimed partitions reached their
+// end with Config.Bounded. It is nil unless Config.Bounded.Enabled is set. The consumer
+// group keeps running until it is closed, so keep watching Done() for failures.
+func (cg *ConsumerGroup) Finished() <-chan struct{} {
+	return cg.finished
+}
+
+// Err returns a *FatalError if the consumer group stopped consuming because it
+// could not recover from repeated failures, and nil otherwise.
+func (cg *ConsumerGroup) Err() error {
+	cg.mu.Lock()
+	defer cg.mu.Unlock()
+	return cg.err
+}
+
 func (cg *ConsumerGroup) Closed() bool {
 	return cg.instance == nil
 }
@@ -292,24 +930,52 @@ func (cg *ConsumerGroup) Close() error {
 		cg.mu.Unlock()
 
 		cg.wg.Wait()
+		cg.background.Wait()
 
 		if err := cg.offsetManager.Close(); err != nil {
 			cg.Logf("FAILED closing the offset manager: %s!\n", err)
 		}
 
-		if shutdownError = cg.instance.Deregister(); shutdownError != nil {
-			cg.Logf("FAILED deregistering consumer instance: %s!\n", shutdownError)
-		} else {
-			cg.Logf("Deregistered consumer instance %s.\n", cg.instanceID)
+		if cg.registers() {
+			if shutdownError = cg.instance.Deregister(); shutdownError != nil {
+				cg.Logf("FAILED deregistering consumer instance: %s!\n", shutdownError)
+			} else {
+				cg.Logf("Deregistered consumer instance %s.\n", cg.instanceID)
+			}
 		}
 
 		if shutdownError = cg.consumer.Close(); shutdownError != nil {
 			cg.Logf("FAILED closing the Sarama client: %s\n", shutdownError)
 		}
 
+		if cg.deadLetters != nil {
+			if err := cg.deadLetters.Close(); err != nil {
+				cg.Logf("FAILED closing the dead letter producer: %s\n", err)
+			}
+		}
+
+		if err := closeFetchConsumers(cg.fetchConsumers); err != nil {
+			cg.Logf("FAILED closing the Sarama clients of the topics: %s\n", err)
+		}
+
+		if cg.client != nil {
+			if err := cg.client.Close(); err != nil {
+				cg.Logf("FAILED closing the Sarama client: %s\n", err)
+			}
+		}
+
+		if cg.conn != nil {
+			cg.conn.Close()
+		}
+
 		close(cg.messages)
+		if cg.batches != nil {
+			close(cg.batches)
+		}
 		close(cg.errors)
+		cg.closeNotifications()
 		cg.instance = nil
+		cg.doneOnce.Do(func() { close(cg.done) })
 	})
 
 	return shutdownError
@@ -329,6 +995,35 @@ func (cg *ConsumerGroup) InstanceRegistered() (bool, error) {
 	return cg.instance.Registered()
 }
 
+// Members returns the instances that are currently registered in the consumer group,
+// with the metadata they registered and the partitions they have claimed.
+func (cg *ConsumerGroup) Members() ([]*Member, error) {
+	members, err := cg.group.Instances()
+	if err != nil {
+		return nil, err
+	}
+	sortMembers(members)
+
+	owners, err := cg.group.PartitionOwners()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, member := range members {
+		member.Claims = make(map[string][]int32)
+		for topic, partitions := range owners {
+			for partition, owner := range partitions {
+				if owner == member.ID {
+					member.Claims[topic] = append(member.Claims[topic], partition)
+				}
+			}
+			slices.Sort(member.Claims[topic])
+		}
+	}
+
+	return members, nil
+}
+
 func (cg *ConsumerGroup) CommitUpto(message *sarama.ConsumerMessage) error {
 	cg.offsetManager.MarkAsProcessed(message.Topic, message.Partition, message.Offset)
 	return nil
@@ -338,8 +1033,49 @@ func (cg *ConsumerGroup) FlushOffsets() error {
 	return cg.offsetManager.Flush()
 }
 
+// RewindOffset stores offset as the next offset to consume for a partition, even if that
+// moves the stored offset backwards. It is meant for intentional rewinds by admin tooling,
+// and bypasses Offsets.Regression. The partition cannot be consumed by this or any other
+// instance while rewinding it, because its owner would commit its own offset over the
+// rewound one. Shadow instances return ShadowReadOnly.
+func (cg *ConsumerGroup) RewindOffset(topic string, partition int32, offset int64) error {
+	if cg.config.Shadow.Enabled {
+		return ShadowReadOnly
+	}
+	if offset < 0 {
+		return fmt.Errorf("Cannot rewind %s/%d to negative offset %d", topic, partition, offset)
+	}
+	if cg.consuming(topic, partition) {
+		return PartitionInUse
+	}
+
+	// A claim after the check bumps the epoch, which fails the commit below.
+	epoch, err := cg.group.PartitionEpoch(topic, partition)
+	if err != nil {
+		return err
+	}
+	owners, err := cg.group.PartitionOwners()
+	if err != nil {
+		return err
+	}
+	if owner, ok := owners[topic][partition]; ok {
+		cg.Logf("%s/%d :: REFUSED to rewind the stored offset, the partition is claimed by %s\n", topic, partition, owner)
+		return PartitionInUse
+	}
+
+	cg.Logf("%s/%d :: Rewinding the stored offset to %d\n", topic, partition, offset)
+	err = cg.group.CommitOffset(topic, partition, offset, epoch, -1)
+	if err == ErrPartitionFenced {
+		cg.Logf("%s/%d :: REFUSED to rewind the stored offset, the partition was claimed in the meantime\n", topic, partition)
+		return PartitionInUse
+	}
+	return err
+}
+
 func (cg *ConsumerGroup) topicListConsumer(topics []string) {
 	limiter := newDefaultLimiter()
+	failures := 0
+	var members []string
 	for {
 		// Ensure that we wait for the cg.topicConsumer() Go routines to complete in cg.Close()
 		// This has to happen before checking the cg.stopper channel because otherwise
@@ -354,23 +1090,76 @@ func (cg *ConsumerGroup) topicListConsumer(topics []string) {
 		default:
 		}
 
-		ctx, cancel := context.WithCancel(context.Background())
+		// The session may have expired while the previous rebalance waited for the partition
+		// consumers. The registration is gone then, and the watch below would not notice.
+		select {
+		case <-cg.sessionExpired:
+			cg.ensureRegistered(topics)
+		default:
+		}
+
+		ctx, abort := context.WithCancelCause(context.Background())
+		cancel := func() { abort(nil) }
 		limiter.Wait(ctx)
 
-		consumers, consumerChanges, err := cg.group.WatchInstances()
+		// Static instances consume the same partitions until they close, so they do not
+		// watch the other instances.
+		var consumers []*Member
+		var consumerChanges <-chan zk.Event
+		var err error
+		if cg.registers() {
+			consumers, consumerChanges, err = cg.group.WatchInstances()
+		}
 		if err != nil {
 			cg.Logf("FAILED to get list of registered consumer instances: %s\n", err)
 			cancel()
 			cg.mu.Unlock()
-			return
+
+			failures++
+			if !cg.retryAfterBackoff(topics, failures, err) {
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		sortMembers(consumers)
+		cg.consumers = activeMembers(consumers)
+		if cg.registers() {
+			cg.Logf("Currently registered consumers: %d (%d active)\n", len(consumers), len(cg.consumers))
+		}
+		if cg.config.Instance.Standby {
+			if slices.ContainsFunc(cg.consumers, func(m *Member) bool { return m.ID == cg.instanceID }) {
+				cg.Logf("Standby instance promoted to active\n")
+			} else {
+				cg.Logf("Standing by\n")
+			}
 		}
 
-		cg.consumers = consumers
-		cg.Logf("Currently registered consumers: %d\n", len(cg.consumers))
+		if cg.notifications != nil {
+			// Sending notifications may block until cg.Close(), which needs the lock.
+			active := instanceIDs(cg.consumers)
+			cg.mu.Unlock()
+			if ids := instanceIDs(consumers); !slices.Equal(ids, members) {
+				members = ids
+				cg.notify(&MembershipChanged{Instances: ids})
+			}
+			cg.notify(&RebalanceStart{Instances: active})
+
+			cg.mu.Lock()
+			select {
+			case <-cg.stopper:
+				cancel()
+				cg.mu.Unlock()
+				return
+			default:
+			}
+		}
 
+		assigned := newAssignment(cg, len(topics))
 		for _, topic := range topics {
 			cg.wg.Add(1)
-			go cg.topicConsumer(ctx, cancel, topic, cg.messages, cg.errors)
+			go cg.topicConsumer(ctx, cancel, topic, assigned, cg.messages, cg.errors)
 		}
 
 		// Ensure that we wait for the cg.topicConsumer() Go routines to complete in cg.Close()
@@ -390,28 +1179,188 @@ func (cg *ConsumerGroup) topicListConsumer(topics []string) {
 			cancel()
 			return
 
-		case <-consumerChanges:
-			registered, err := cg.instance.Registered()
-			if err != nil {
-				cg.Logf("FAILED to get register status: %s\n", err)
-			} else if !registered {
-				err = cg.instance.Register(topics)
-				if err != nil {
-					cg.Logf("FAILED to register consumer instance: %s!\n", err)
-				} else {
-					cg.Logf("Consumer instance registered (%s).", cg.instanceID)
-				}
+		case <-cg.sessionExpired:
+			cg.abandonPartitions(topics, abort)
+
+		case event := <-consumerChanges:
+			if event.Err == zk.ErrSessionExpired {
+				cg.abandonPartitions(topics, abort)
+				break
 			}
 
+			cg.ensureRegistered(topics)
+
 			cg.Logf("Triggering rebalance due to consumer list change\n")
 			cancel()
 			cg.wg.Wait()
 		}
+		cancel()
+	}
+}
+
+// abandonPartitions stops all partition consumers after the session expired, without
+// committing offsets or releasing claims, and registers the instance again.
+func (cg *ConsumerGroup) abandonPartitions(topics []string, abort context.CancelCauseFunc) {
+	cg.Logf("Abandoning all partitions due to session expiry\n")
+	abort(SessionExpired)
+	cg.wg.Wait()
+	cg.ensureRegistered(topics)
+}
+
+// watchSession forwards the session events of the Zookeeper connection, and triggers
+// a rebalance when the session expires.
+func (cg *ConsumerGroup) watchSession(events <-chan zk.Event) {
+	defer close(cg.sessionEvents)
+
+	for event := range events {
+		if event.Type != zk.EventSession {
+			continue
+		}
+
+		var session SessionEvent
+		switch event.State {
+		case zk.StateExpired:
+			cg.Logf("Zookeeper session expired\n")
+			select {
+			case cg.sessionExpired <- struct{}{}:
+			default:
+			}
+			session = SessionEvent{State: SessionLost}
+		case zk.StateDisconnected:
+			cg.Logf("Disconnected from Zookeeper\n")
+			session = SessionEvent{State: SessionDisconnected}
+		case zk.StateHasSession:
+			cg.Logf("Connected to Zookeeper (%s)\n", event.Server)
+			session = SessionEvent{State: SessionConnected, Server: event.Server}
+		default:
+			continue
+		}
+
+		select {
+		case cg.sessionEvents <- session:
+		default:
+		}
+
+		if cg.electionEvents != nil {
+			select {
+			case cg.electionEvents <- event:
+			default:
+			}
+		}
+	}
+}
+
+// retryAfterBackoff waits before the next attempt to watch the consumer instances, making sure
+// this instance is still registered. It returns false if the consumer group should
+// stop, either because it is closing or because it gave up after too many failures.
+func (cg *ConsumerGroup) retryAfterBackoff(topics []string, failures int, err error) bool {
+	if limit := cg.config.Recovery.MaxFailures; limit > 0 && failures >= limit {
+		cg.fail(&FatalError{Failures: failures, Err: err})
+		return false
+	}
+
+	backoff := cg.backoff(failures)
+	cg.Logf("Retrying in %s (attempt %d)\n", backoff, failures+1)
+	select {
+	case <-cg.stopper:
+		return false
+	case <-time.After(backoff):
+	}
+
+	cg.ensureRegistered(topics)
+	return true
+}
+
+// isStatic returns whether the instance consumes a static assignment instead of taking
+// part in the consumer group.
+func (cg *ConsumerGroup) isStatic() bool {
+	return cg.config.StaticAssignment != nil
+}
+
+// registers returns whether the instance registers in the consumer group, and has the
+// partitions divided between it and the other registered instances.
+func (cg *ConsumerGroup) registers() bool {
+	return !cg.isStatic() && !cg.config.Broadcast.Enabled && !cg.config.Shadow.Enabled
+}
+
+// claimsPartitions returns whether the instance claims the partitions it consumes.
+// Broadcast instances consume every partition, and shadow instances must not keep the
+// group from consuming them.
+func (cg *ConsumerGroup) claimsPartitions() bool {
+	return !cg.config.Broadcast.Enabled && !cg.config.Shadow.Enabled
+}
+
+// backoff returns the time to wait before the next attempt after a number of
+// consecutive failures.
+func (cg *ConsumerGroup) backoff(failures int) time.Duration {
+	backoff, maxBackoff := cg.config.recoveryBackoff()
+	for i := 1; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// recoveryBackoff returns the initial and the maximum time to wait between retries,
+// using the defaults for durations that are not set.
+func (cgc *Config) recoveryBackoff() (time.Duration, time.Duration) {
+	backoff, maxBackoff := cgc.Recovery.Backoff, cgc.Recovery.MaxBackoff
+	if backoff == 0 {
+		backoff = 1 * time.Second
+	}
+	if maxBackoff == 0 {
+		maxBackoff = 30 * time.Second
+	}
+	return backoff, maxBackoff
+}
+
+// ensureRegistered registers this instance again if its registration has disappeared
+// from Zookeeper.
+func (cg *ConsumerGroup) ensureRegistered(topics []string) {
+	if !cg.registers() {
+		return
+	}
+
+	registered, err := cg.instance.Registered()
+	if err != nil {
+		cg.Logf("FAILED to get register status: %s\n", err)
+	} else if !registered {
+		err = cg.instance.Register(topics)
+		if err != nil {
+			cg.Logf("FAILED to register consumer instance: %s!\n", err)
+		} else {
+			cg.Logf("Consumer instance registered (%s).", cg.instanceID)
+		}
+	}
+}
+
+// fail stops the consumer group permanently. The error is reported on the errors
+// channel if there is room for it, and is always available through Err.
+func (cg *ConsumerGroup) fail(err error) {
+	cg.Logf("Giving up: %s\n", err)
+
+	cg.mu.Lock()
+	defer cg.mu.Unlock()
+
+	select {
+	case <-cg.stopper:
+		return
+	default:
+	}
+
+	cg.err = err
+	select {
+	case cg.errors <- err:
+	default:
 	}
+	cg.doneOnce.Do(func() { close(cg.done) })
 }
 
-func (cg *ConsumerGroup) topicConsumer(ctx context.Context, cancel context.CancelFunc, topic string, messages chan<- *sarama.ConsumerMessage, errors chan<- error) {
+func (cg *ConsumerGroup) topicConsumer(ctx context.Context, cancel context.CancelFunc, topic string, assigned *assignment, messages chan<- *sarama.ConsumerMessage, errors chan<- error) {
 	defer cg.wg.Done()
+	defer assigned.cancel(topic)
 
 	select {
 	case <-ctx.Done():
@@ -446,37 +1395,99 @@ func (cg *ConsumerGroup) topicConsumer(ctx context.Context, cancel context.Cance
 		return
 	}
 
-	dividedPartitions := dividePartitionsBetweenConsumers(cg.consumers, topicPartitionLeaders)
-	myPartitions := dividedPartitions[cg.instanceID]
+	if cg.registers() && usesRacks(cg.config.Assignor) {
+		// Without the racks, the partitions are assigned as if no broker registered one.
+		if racks, err := cg.kazoo.BrokerRacks(); err != nil {
+			cg.Logf("%s :: FAILED to get racks of brokers: %s\n", topic, err)
+		} else {
+			for _, pl := range topicPartitionLeaders {
+				pl.LeaderRack = racks[pl.Leader]
+			}
+		}
+	}
+	sort.Sort(topicPartitionLeaders)
+
+	var myPartitions []*Partition
+	if cg.isStatic() {
+		myPartitions = cg.staticPartitions(topic, topicPartitionLeaders)
+	} else if !cg.registers() {
+		myPartitions = topicPartitionLeaders
+	} else {
+		dividedPartitions := cg.config.Assignor.Assign(topic, cg.consumers, topicPartitionLeaders)
+		myPartitions = dividedPartitions[cg.instanceID]
+	}
 	cg.Logf("%s :: Claiming %d of %d partitions", topic, len(myPartitions), len(topicPartitionLeaders))
 
+	ids := make([]int32, 0, len(myPartitions))
+	for _, pid := range myPartitions {
+		ids = append(ids, pid.ID)
+	}
+	assigned.add(topic, ids)
+
 	// Consume all the assigned partitions
 	var wg sync.WaitGroup
 	for _, pid := range myPartitions {
 		wg.Add(1)
-		go cg.partitionConsumer(ctx, topic, pid.ID, messages, errors, &wg)
+		go cg.partitionConsumer(ctx, topic, pid.ID, assigned, messages, errors, &wg)
 	}
 
 	wg.Wait()
 	cg.Logf("%s :: Stopped topic consumer\n", topic)
 }
 
+// staticPartitions returns the partitions of the static assignment of a topic. Partitions
+// the topic does not have are reported as errors.
+func (cg *ConsumerGroup) staticPartitions(topic string, partitions partitionLeaders) []*Partition {
+	var result []*Partition
+	for _, id := range cg.config.StaticAssignment[topic] {
+		i := slices.IndexFunc(partitions, func(p *Partition) bool { return p.ID == id })
+		if i < 0 {
+			cg.Logf("%s/%d :: Partition does not exist\n", topic, id)
+			cg.errors <- &sarama.ConsumerError{
+				Topic:     topic,
+				Partition: id,
+				Err:       sarama.ErrUnknownTopicOrPartition,
+			}
+			continue
+		}
+		result = append(result, partitions[i])
+	}
+	return result
+}
+
 func (cg *ConsumerGroup) consumePartition(topic string, partition int32, nextOffset int64) (sarama.PartitionConsumer, error) {
-	consumer, err := cg.consumer.ConsumePartition(topic, partition, nextOffset)
+	consumer, err := cg.consumerFor(topic).ConsumePartition(topic, partition, nextOffset)
 	if err == sarama.ErrOffsetOutOfRange {
+		staleOffset := nextOffset
 		cg.Logf("%s/%d :: Partition consumer offset out of Range.\n", topic, partition)
-		// if the offset is out of range, simplistically decide whether to use OffsetNewest or OffsetOldest
-		// if the configuration specified offsetOldest, then switch to the oldest available offset, else
-		// switch to the newest available offset.
-		if cg.config.Offsets.Initial == sarama.OffsetOldest {
-			nextOffset = sarama.OffsetOldest
+		// if the offset is out of range, continue from where the out-of-range policy of
+		// the topic says, or stop consuming the partition.
+		if nextOffset, err = cg.config.outOfRangeOffset(topic, partition, staleOffset); err != nil {
+			cg.Logf("%s/%d :: Partition consumer offset %d is not available: %s\n", topic, partition, staleOffset, err)
+			cg.errors <- &sarama.ConsumerError{
+				Topic:     topic,
+				Partition: partition,
+				Err:       err,
+			}
+			return nil, err
+		}
+		switch nextOffset {
+		case sarama.OffsetOldest:
 			cg.Logf("%s/%d :: Partition consumer offset reset to oldest available offset.\n", topic, partition)
-		} else {
-			nextOffset = sarama.OffsetNewest
+		case sarama.OffsetNewest:
 			cg.Logf("%s/%d :: Partition consumer offset reset to newest available offset.\n", topic, partition)
+		default:
+			cg.Logf("%s/%d :: Partition consumer offset reset to %d.\n", topic, partition, nextOffset)
 		}
 		// retry the consumePartition with the adjusted offset
-		consumer, err = cg.consumer.ConsumePartition(topic, partition, nextOffset)
+		nextOffset = cg.resolveOffset(topic, partition, nextOffset)
+		consumer, err = cg.consumerFor(topic).ConsumePartition(topic, partition, nextOffset)
+		if err == nil {
+			cg.notify(&OffsetReset{Topic: topic, Partition: partition, OldOffset: staleOffset, NewOffset: nextOffset})
+			if staleOffset >= 0 && nextOffset > staleOffset {
+				cg.reportDataLoss(topic, partition, staleOffset, nextOffset)
+			}
+		}
 	}
 	if err != nil {
 		cg.Logf("%s/%d :: FAILED to start partition consumer: %s\n", topic, partition, err)
@@ -485,23 +1496,44 @@ func (cg *ConsumerGroup) consumePartition(topic string, partition int32, nextOff
 	return consumer, err
 }
 
-// Consumes a partition
-func (cg *ConsumerGroup) partitionConsumer(ctx context.Context, topic string, partition int32, messages chan<- *sarama.ConsumerMessage, errors chan<- error, wg *sync.WaitGroup) {
-	defer wg.Done()
+// reportDataLoss reports that the messages from offset up to next were skipped.
+func (cg *ConsumerGroup) reportDataLoss(topic string, partition int32, offset, next int64) {
+	cg.Logf("%s/%d :: SKIPPED %d messages from offset %d to %d!\n", topic, partition, next-offset, offset, next)
+	metrics.GetOrRegisterCounter("consumergroup-lost-messages", cg.config.MetricRegistry).Inc(next - offset)
+	cg.notify(&DataLoss{Topic: topic, Partition: partition, From: offset, To: next})
+}
+
+// resolveOffset turns sarama.OffsetOldest and sarama.OffsetNewest into the actual offset
+// they currently refer to. The offset is returned as is if it cannot be resolved.
+func (cg *ConsumerGroup) resolveOffset(topic string, partition int32, offset int64) int64 {
+	if cg.client == nil || offset >= 0 {
+		return offset
+	}
+
+	resolved, err := cg.client.GetOffset(topic, partition, offset)
+	if err != nil {
+		cg.Logf("%s/%d :: FAILED to resolve offset: %s\n", topic, partition, err)
+		return offset
+	}
+	return resolved
+}
 
+// claimPartition claims the partition, waiting for the instance that owns it to release
+// it. It returns the epoch of the claim, and false if the partition could not be claimed.
+func (cg *ConsumerGroup) claimPartition(ctx context.Context, topic string, partition int32) (int32, bool) {
 	// Since ProcessingTimeout is the amount of time we'll wait for the final batch
 	// of messages to be processed before releasing a partition, we need to wait slightly
 	// longer than that before timing out here to ensure that another consumer has had
 	// enough time to release the partition. Hence, +2 seconds.
-	maxRetries := int(cg.config.Offsets.ProcessingTimeout/time.Second) + 2
-partitionClaimLoop:
+	maxRetries := int(cg.config.processingTimeout(topic)/time.Second) + 2
 	for tries := 0; tries < maxRetries; tries++ {
 		select {
 		case <-ctx.Done():
-			return
+			return -1, false
 		case <-time.After(1 * time.Second):
-			if err := cg.instance.ClaimPartition(topic, partition); err == nil {
-				break partitionClaimLoop
+			epoch, err := cg.instance.ClaimPartition(topic, partition)
+			if err == nil {
+				return epoch, true
 			} else if tries+1 < maxRetries {
 				if err == kazoo.ErrPartitionClaimedByOther {
 					// Another consumer still owns this partition. We should wait longer for it to release it.
@@ -516,12 +1548,45 @@ partitionClaimLoop:
 					Partition: partition,
 					Err:       err,
 				}
-				return
+				return -1, false
 			}
 		}
 	}
+	return -1, false
+}
+
+// Consumes a partition
+func (cg *ConsumerGroup) partitionConsumer(ctx context.Context, topic string, partition int32, assigned *assignment, messages chan<- *sarama.ConsumerMessage, errors chan<- error, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+
+	epoch := int32(-1)
+	if cg.claimsPartitions() {
+		var ok bool
+		if epoch, ok = cg.claimPartition(ctx, topic, partition); !ok {
+			return
+		}
+	}
+
+	cg.addClaim(topic, partition, &partitionClaim{epoch: epoch, abort: abort})
+	defer cg.removeClaim(topic, partition)
+	if cg.claimsPartitions() {
+		cg.notify(&PartitionClaimed{Topic: topic, Partition: partition})
+	}
+
+	var lastOffset int64 = -1 // aka unknown
 
+	// Whether the final commit found the partition claimed by another instance. The context
+	// may already be cancelled by then, so it cannot record this.
+	fenced := false
 	defer func() {
+		if fenced || claimLost(ctx) || !cg.claimsPartitions() {
+			// The claim disappeared along with the session, or already belongs to another instance.
+			return
+		}
+
 		err := cg.instance.ReleasePartition(topic, partition)
 		if err != nil {
 			cg.Logf("%s/%d :: FAILED to release partition: %s\n", topic, partition, err)
@@ -530,7 +1595,9 @@ partitionClaimLoop:
 				Partition: partition,
 				Err:       err,
 			}
+			return
 		}
+		cg.notify(&PartitionReleased{Topic: topic, Partition: partition, LastOffset: lastOffset})
 	}()
 
 	nextOffset, err := cg.offsetManager.InitializePartition(topic, partition)
@@ -539,15 +1606,50 @@ partitionClaimLoop:
 		return
 	}
 
+	if nextOffset < 0 {
+		nextOffset = cg.config.initialOffset(topic)
+	}
+
+	// The offset the partition consumer starts at. It is only resolved when counting the
+	// attempts or checking for the end offset needs it.
+	start := nextOffset
+	if cg.config.Poison.MaxAttempts > 0 {
+		// Without a committed offset, the attempts count against the offset the initial
+		// offset currently refers to.
+		if start = cg.startOffset(topic, partition, nextOffset); start >= 0 {
+			nextOffset = cg.checkPoison(topic, partition, start)
+			start = nextOffset
+		}
+	}
+
 	if nextOffset >= 0 {
 		cg.Logf("%s/%d :: Partition consumer starting at offset %d.\n", topic, partition, nextOffset)
-	} else {
-		nextOffset = cg.config.Offsets.Initial
-		if nextOffset == sarama.OffsetOldest {
-			cg.Logf("%s/%d :: Partition consumer starting at the oldest available offset.\n", topic, partition)
-		} else if nextOffset == sarama.OffsetNewest {
-			cg.Logf("%s/%d :: Partition consumer listening for new messages only.\n", topic, partition)
+	} else if nextOffset == sarama.OffsetOldest {
+		cg.Logf("%s/%d :: Partition consumer starting at the oldest available offset.\n", topic, partition)
+	} else if nextOffset == sarama.OffsetNewest {
+		cg.Logf("%s/%d :: Partition consumer listening for new messages only.\n", topic, partition)
+	}
+
+	end := int64(-1) // aka unbounded
+	finished := false
+	if cg.config.Bounded.Enabled {
+		if end, err = cg.partitionEnd(topic, partition); err != nil {
+			cg.Logf("%s/%d :: FAILED to determine the end offset: %s\n", topic, partition, err)
+			cg.errors <- &sarama.ConsumerError{
+				Topic:     topic,
+				Partition: partition,
+				Err:       err,
+			}
+			return
+		}
+		cg.Logf("%s/%d :: Partition consumer stopping at offset %d.\n", topic, partition, end)
+		if start < 0 {
+			start = cg.startOffset(topic, partition, nextOffset)
 		}
+		finished = start >= end
+	}
+	reachedEnd := func(offset int64) bool {
+		return end >= 0 && offset >= end-1
 	}
 
 	consumer, err := cg.consumePartition(topic, partition, nextOffset)
@@ -559,18 +1661,66 @@ partitionClaimLoop:
 
 	defer consumer.Close()
 
+	var batch *batchBuilder
+	if cg.batches != nil {
+		batch = newBatchBuilder(cg, topic, partition)
+		defer batch.discard()
+	}
+
+	// A partition whose last messages before the end offset are transaction markers never
+	// delivers a message at end-1. When no message arrived for twice the fetch MaxWaitTime,
+	// the records that were not delivered yet are fetched, to find out whether they are
+	// all markers, or messages of aborted transactions.
+	var endCheck <-chan time.Time
+	if end >= 0 && !finished {
+		ticker := time.NewTicker(2 * cg.config.maxWaitTime(topic))
+		defer ticker.Stop()
+		endCheck = ticker.C
+	}
+	received := false
+	next := start // The offset after the last message received.
+
+	// The offset manager stores how far every attempt got, to find the message an attempt
+	// that does not end cleanly failed on.
+	var attempts attemptTracker
+	if cg.config.Poison.MaxAttempts > 0 {
+		attempts, _ = cg.offsetManager.(attemptTracker)
+	}
+
 	err = nil
-	var lastOffset int64 = -1 // aka unknown
 partitionConsumerLoop:
-	for {
+	for !finished {
 		select {
 		case <-ctx.Done():
 			break partitionConsumerLoop
 
+		case <-endCheck:
+			if received || consumer.HighWaterMarkOffset() < end {
+				received = false
+				continue partitionConsumerLoop
+			}
+			if markers, err := cg.onlyMarkersBefore(topic, partition, next, end); err != nil {
+				cg.Logf("%s/%d :: FAILED to check for transaction markers before the end offset: %s\n", topic, partition, err)
+				continue partitionConsumerLoop
+			} else if !markers {
+				continue partitionConsumerLoop
+			}
+			if batch != nil && len(batch.messages) > 0 {
+				offset, ok := batch.deliver(ctx)
+				if !ok {
+					break partitionConsumerLoop
+				}
+				lastOffset = offset
+			}
+			finished = true
+
 		case err := <-consumer.Errors():
 			if err == nil {
 				cg.Logf("%s/%d :: Consumer encountered an invalid state: re-establishing consumption of partition.\n", topic, partition)
 
+				// The messages after lastOffset are consumed again.
+				batch.discard()
+
 				// Errors encountered (if any) are logged in the consumerPartition function
 				var cErr error
 				consumer, cErr = cg.consumePartition(topic, partition, lastOffset)
@@ -590,10 +1740,20 @@ partitionConsumerLoop:
 				}
 			}
 
+		case <-batch.expired():
+			offset, ok := batch.deliver(ctx)
+			if !ok {
+				break partitionConsumerLoop
+			}
+			lastOffset = offset
+
 		case message := <-consumer.Messages():
 			if message == nil {
 				cg.Logf("%s/%d :: Consumer encountered an invalid state: re-establishing consumption of partition.\n", topic, partition)
 
+				// The messages after lastOffset are consumed again.
+				batch.discard()
+
 				// Errors encountered (if any) are logged in the consumerPartition function
 				var cErr error
 				consumer, cErr = cg.consumePartition(topic, partition, lastOffset)
@@ -603,6 +1763,60 @@ partitionConsumerLoop:
 				continue partitionConsumerLoop
 
 			}
+			received, next = true, message.Offset+1
+			if attempts != nil {
+				attempts.MarkAsReceived(topic, partition, message.Offset)
+			}
+
+			if end >= 0 && message.Offset >= end {
+				// The messages before the end offset were removed, e.g. by compaction.
+				if batch != nil && len(batch.messages) > 0 {
+					offset, ok := batch.deliver(ctx)
+					if !ok {
+						break partitionConsumerLoop
+					}
+					lastOffset = offset
+				}
+				finished = true
+				continue partitionConsumerLoop
+			}
+
+			if err := cg.throttles.wait(ctx, message); err != nil {
+				break partitionConsumerLoop
+			}
+
+			if batch != nil {
+				if !batch.fits(message) {
+					offset, ok := batch.deliver(ctx)
+					if !ok {
+						break partitionConsumerLoop
+					}
+					lastOffset = offset
+				}
+				if batch.add(message) || reachedEnd(message.Offset) {
+					offset, ok := batch.deliver(ctx)
+					if !ok {
+						break partitionConsumerLoop
+					}
+					lastOffset = offset
+					finished = reachedEnd(offset)
+				}
+				continue partitionConsumerLoop
+			}
+
+			if cg.scheduler != nil {
+				// The scheduler admits the message when it takes it from the queue.
+				if !cg.scheduler.enqueue(ctx.Done(), message) {
+					break partitionConsumerLoop
+				}
+				lastOffset = message.Offset
+				finished = reachedEnd(lastOffset)
+				continue partitionConsumerLoop
+			}
+
+			if !cg.breaker.admit(ctx.Done(), nil, message) {
+				break partitionConsumerLoop
+			}
 
 			for {
 				select {
@@ -611,14 +1825,134 @@ partitionConsumerLoop:
 
 				case messages <- message:
 					lastOffset = message.Offset
+					finished = reachedEnd(lastOffset)
 					continue partitionConsumerLoop
 				}
 			}
 		}
 	}
 
+	if finished {
+		switch cg.finishPartition(ctx, topic, partition, lastOffset, assigned) {
+		case nil:
+			// Keep the claim, so that no other instance consumes the partition past its end.
+			<-ctx.Done()
+			return
+		case ErrPartitionFenced:
+			fenced = true
+		}
+	}
+
+	if cg.scheduler != nil {
+		// Messages that are still queued are delivered by the next claim instead.
+		if delivered, ok := cg.scheduler.remove(topic, partition); ok {
+			lastOffset = delivered
+		}
+	}
+
+	if fenced || claimLost(ctx) {
+		cause := context.Cause(ctx)
+		if fenced {
+			cause = ErrPartitionFenced
+		}
+		cg.Logf("%s/%d :: Abandoning partition consumer at offset %d: %s\n", topic, partition, lastOffset, cause)
+		if discarder, ok := cg.offsetManager.(partitionDiscarder); ok {
+			discarder.DiscardPartition(topic, partition)
+		}
+		if cause == ErrPartitionFenced {
+			cg.reportFenced(topic, partition)
+		}
+		return
+	}
+
 	cg.Logf("%s/%d :: Stopping partition consumer at offset %d\n", topic, partition, lastOffset)
-	if err := cg.offsetManager.FinalizePartition(topic, partition, lastOffset, cg.config.Offsets.ProcessingTimeout); err != nil {
+	err = cg.offsetManager.FinalizePartition(topic, partition, lastOffset, cg.config.processingTimeout(topic))
+	switch {
+	case err == ErrPartitionFenced:
+		// Another instance claimed the partition, so it must not be released either.
+		fenced = true
+		cg.Logf("%s/%d :: %s\n", topic, partition, err)
+		cg.reportFenced(topic, partition)
+	case err != nil:
 		cg.Logf("%s/%d :: %s\n", topic, partition, err)
+	default:
+		cg.clearAttempts(topic, partition)
+	}
+}
+
+// reportFenced reports that an offset of a partition was not committed, because another
+// instance claimed the partition in the meantime.
+func (cg *ConsumerGroup) reportFenced(topic string, partition int32) {
+	cg.errors <- &sarama.ConsumerError{
+		Topic:     topic,
+		Partition: partition,
+		Err:       ErrPartitionFenced,
+	}
+}
+
+// claimLost returns whether the partition consumer was stopped because this instance no
+// longer owns the partition, in which case it must not commit or release it.
+func claimLost(ctx context.Context) bool {
+	cause := context.Cause(ctx)
+	return cause == SessionExpired || cause == ErrPartitionFenced
+}
+
+func (cg *ConsumerGroup) addClaim(topic string, partition int32, claim *partitionClaim) {
+	cg.claimsMu.Lock()
+	defer cg.claimsMu.Unlock()
+
+	if cg.claims == nil {
+		cg.claims = make(map[string]map[int32]*partitionClaim)
+	}
+	if cg.claims[topic] == nil {
+		cg.claims[topic] = make(map[int32]*partitionClaim)
+	}
+	cg.claims[topic][partition] = claim
+}
+
+func (cg *ConsumerGroup) removeClaim(topic string, partition int32) {
+	cg.claimsMu.Lock()
+	defer cg.claimsMu.Unlock()
+
+	delete(cg.claims[topic], partition)
+}
+
+// consuming returns whether this instance consumes a partition, whether it claimed it or not.
+func (cg *ConsumerGroup) consuming(topic string, partition int32) bool {
+	cg.claimsMu.Lock()
+	defer cg.claimsMu.Unlock()
+
+	_, ok := cg.claims[topic][partition]
+	return ok
+}
+
+// currentClaim returns the current claim on a partition, or nil if this instance does not
+// consume the partition.
+func (cg *ConsumerGroup) currentClaim(topic string, partition int32) *partitionClaim {
+	cg.claimsMu.Lock()
+	defer cg.claimsMu.Unlock()
+
+	return cg.claims[topic][partition]
+}
+
+// claimEpoch returns the epoch of the current claim on a partition, or -1 if the
+// partition is not claimed by this instance.
+func (cg *ConsumerGroup) claimEpoch(topic string, partition int32) int32 {
+	cg.claimsMu.Lock()
+	defer cg.claimsMu.Unlock()
+
+	if claim, ok := cg.claims[topic][partition]; ok {
+		return claim.epoch
+	}
+	return -1
+}
+
+// fencePartition stops consuming a partition that has been claimed by another instance.
+func (cg *ConsumerGroup) fencePartition(topic string, partition int32) {
+	cg.claimsMu.Lock()
+	defer cg.claimsMu.Unlock()
+
+	if claim, ok := cg.claims[topic][partition]; ok {
+		claim.abort(ErrPartitionFenced)
 	}
 }
@@ -7,27 +7,27 @@ import (
 	"fmt"
 	"math"
 	"testing"
-
-	"github.com/wvanbergen/kazoo-go"
+	"time"
 )
 
-func createTestConsumerGroupInstanceList(size int) kazoo.ConsumergroupInstanceList {
-	k := make(kazoo.ConsumergroupInstanceList, size)
+func createTestConsumerGroupInstanceList(size int) []*Member {
+	k := make([]*Member, size)
 	for i := range k {
-		k[i] = &kazoo.ConsumergroupInstance{ID: fmt.Sprintf("consumer%d", i)}
+		k[i] = &Member{ID: fmt.Sprintf("consumer%d", i)}
 	}
+	sortMembers(k)
 	return k
 }
 
-func createTestPartitions(count int) []partitionLeader {
+func createTestPartitions(count int) partitionLeaders {
 	if count < 0 || count > math.MaxInt32 {
 		panic("partition count exceeds int32 range") // satisfy linter check
 	}
 
-	p := make([]partitionLeader, count)
+	p := make(partitionLeaders, count)
 	var partitionID int32
 	for i := range p {
-		p[i] = partitionLeader{id: partitionID, leader: 1, partition: &kazoo.Partition{ID: partitionID}}
+		p[i] = &Partition{ID: partitionID, Leader: 1}
 		partitionID++
 	}
 	return p
@@ -77,3 +77,130 @@ func Test_PartitionDivision(t *testing.T) {
 		}
 	}
 }
+
+func Test_UnsortedPartitionDivision(t *testing.T) {
+	consumers := []*Member{{ID: "consumer1"}, {ID: "consumer0"}}
+	partitions := partitionLeaders{{ID: 3, Leader: 1}, {ID: 1, Leader: 1}, {ID: 2, Leader: 1}, {ID: 0, Leader: 1}}
+
+	division := dividePartitionsBetweenConsumers(consumers, partitions)
+
+	for id, expected := range map[string][]int32{"consumer0": {0, 1}, "consumer1": {2, 3}} {
+		if len(division[id]) != len(expected) || division[id][0].ID != expected[0] || division[id][1].ID != expected[1] {
+			t.Errorf("UnsortedPartitionDivision: Expected %s to be assigned %v, got %v.", id, expected, division[id])
+		}
+	}
+}
+
+func Test_RackAwarePartitionDivision(t *testing.T) {
+	consumers := []*Member{
+		{ID: "consumer0", Rack: "a"},
+		{ID: "consumer1", Rack: "b"},
+		{ID: "consumer2", Rack: "c"},
+	}
+	partitions := partitionLeaders{
+		{ID: 0, Leader: 1, LeaderRack: "b"},
+		{ID: 1, Leader: 1, LeaderRack: "b"},
+		{ID: 2, Leader: 2, LeaderRack: "c"},
+		{ID: 3, Leader: 2, LeaderRack: "c"},
+		{ID: 4, Leader: 3, LeaderRack: "a"},
+		{ID: 5, Leader: 3, LeaderRack: "a"},
+		{ID: 6, Leader: 3, LeaderRack: "a"},
+	}
+
+	division := RackAwareAssignor{}.Assign("topic", consumers, partitions)
+
+	assigned := 0
+	for _, consumer := range consumers {
+		local := 0
+		for _, partition := range division[consumer.ID] {
+			if partition.LeaderRack == consumer.Rack {
+				local++
+			}
+		}
+		if len(division[consumer.ID]) < 2 || len(division[consumer.ID]) > 3 {
+			t.Errorf("RackAwarePartitionDivision: %s was assigned %d partitions", consumer.ID, len(division[consumer.ID]))
+		}
+		if local < 2 {
+			t.Errorf("RackAwarePartitionDivision: %s was assigned only %d partitions in its own rack", consumer.ID, local)
+		}
+		assigned += len(division[consumer.ID])
+	}
+	if assigned != len(partitions) {
+		t.Errorf("RackAwarePartitionDivision: Expected to assign %d partitions, but assigned %d.", len(partitions), assigned)
+	}
+}
+
+func Test_WeightedPartitionDivision(t *testing.T) {
+	consumers := []*Member{
+		{ID: "consumer0", Weight: 1},
+		{ID: "consumer1", Weight: 3},
+		{ID: "consumer2"},
+	}
+	division := dividePartitionsBetweenConsumers(consumers, createTestPartitions(11))
+
+	expected := map[string]int{"consumer0": 2, "consumer1": 7, "consumer2": 2}
+	for id, count := range expected {
+		if len(division[id]) != count {
+			t.Errorf("WeightedPartitionDivision: Expected %s to be assigned %d partitions, got %d.", id, count, len(division[id]))
+		}
+	}
+}
+
+func Test_RulePartitionDivision(t *testing.T) {
+	consumers := []*Member{
+		{ID: "consumer0", Version: "1.9.2"},
+		{ID: "consumer1", Version: "1.10.0", Labels: map[string]string{"role": "canary"}},
+		{ID: "consumer2", Version: "1.10.0"},
+	}
+	assignor := RuleAssignor{Rules: []AssignmentRule{
+		{Partitions: []int32{0}, Members: WithLabel("role", "canary")},
+		{Members: HighestVersion},
+	}}
+
+	division := assignor.Assign("topic", consumers, createTestPartitions(5))
+
+	if len(division["consumer0"]) != 0 {
+		t.Errorf("RulePartitionDivision: Expected the outdated consumer not to be assigned partitions, got %d.", len(division["consumer0"]))
+	}
+	if len(division["consumer1"]) != 3 || division["consumer1"][0].ID != 0 {
+		t.Errorf("RulePartitionDivision: Expected the canary to be assigned partition 0 and two others, got %v.", division["consumer1"])
+	}
+	if len(division["consumer2"]) != 2 {
+		t.Errorf("RulePartitionDivision: Expected consumer2 to be assigned 2 partitions, got %d.", len(division["consumer2"]))
+	}
+}
+
+func Test_RuleWithoutMembersSelector(t *testing.T) {
+	consumers := createTestConsumerGroupInstanceList(2)
+	assignor := RuleAssignor{Rules: []AssignmentRule{{Topic: "topic", Partitions: []int32{0}}}}
+
+	division := assignor.Assign("topic", consumers, createTestPartitions(4))
+	if len(division["consumer0"]) != 2 || len(division["consumer1"]) != 2 {
+		t.Errorf("RuleWithoutMembersSelector: Expected a rule without a selector to allow all members, got %v.", division)
+	}
+}
+
+func Test_StandbyPartitionDivision(t *testing.T) {
+	joined := time.Unix(1500000000, 0)
+	consumers := []*Member{
+		{ID: "consumer0"},
+		{ID: "consumer1", Standby: true, StartTime: joined.Add(time.Minute), activeInstances: 2},
+		{ID: "consumer2", Standby: true, StartTime: joined, activeInstances: 2},
+		{ID: "consumer3"},
+	}
+
+	if active := activeMembers(consumers); len(active) != 2 || active[0].ID != "consumer0" || active[1].ID != "consumer3" {
+		t.Errorf("StandbyPartitionDivision: Expected the standbys not to be active, got %v.", instanceIDs(active))
+	}
+
+	// consumer3 went away, so the standby that joined first takes over.
+	active := activeMembers(consumers[:3])
+	if len(active) != 2 || active[0].ID != "consumer0" || active[1].ID != "consumer2" {
+		t.Errorf("StandbyPartitionDivision: Expected consumer2 to be promoted, got %v.", instanceIDs(active))
+	}
+
+	division := RangeAssignor{}.Assign("topic", active, createTestPartitions(4))
+	if len(division["consumer1"]) != 0 || len(division["consumer2"]) != 2 {
+		t.Errorf("StandbyPartitionDivision: Expected only the promoted standby to be assigned partitions, got %v.", division)
+	}
+}
@@ -42,23 +42,14 @@ func newMockConsumerGroup(name string, topics []string, zookeeper []string, conf
 	}
 	config.ClientID = name
 
-	cg = &ConsumerGroup{
-		config:   config,
-		consumer: &mockSaramaConsumer{},
-
-		kazoo:      &mockZookeeperTopicReader{},
-		group:      &mockConsumerGroupManager{},
-		groupName:  name,
-		instance:   &mockConsumerGroupInstanceManager{},
-		instanceID: "test-instance-id",
-
-		messages: make(chan *sarama.ConsumerMessage, config.ChannelBufferSize),
-		errors:   make(chan error, config.ChannelBufferSize),
-		stopper:  make(chan struct{}),
-	}
+	cg = newConsumerGroup(name, config)
+	cg.consumer = &mockSaramaConsumer{}
+	cg.kazoo = &mockZookeeperTopicReader{}
+	cg.group = &mockConsumerGroupManager{}
+	cg.instance = &mockConsumerGroupInstanceManager{}
+	cg.instanceID = "test-instance-id"
 
-	offsetConfig := OffsetManagerConfig{CommitInterval: config.Offsets.CommitInterval}
-	cg.offsetManager = NewZookeeperOffsetManager(cg, &offsetConfig)
+	cg.startOffsetManager()
 
 	return cg, nil
 }
@@ -66,7 +57,7 @@ func newMockConsumerGroup(name string, topics []string, zookeeper []string, conf
 type mockConsumerGroupManager struct {
 }
 
-func (cgm *mockConsumerGroupManager) CommitOffset(string, int32, int64) error {
+func (cgm *mockConsumerGroupManager) CommitOffset(string, int32, int64, int32, int32) error {
 	return nil
 }
 
@@ -74,6 +65,34 @@ func (cgm *mockConsumerGroupManager) Create() error {
 	return nil
 }
 
+func (cgm *mockConsumerGroupManager) RecordAttempt(string, int32, int64) (int, bool, int64, error) {
+	return 1, false, -1, nil
+}
+
+func (cgm *mockConsumerGroupManager) AdvanceAttempts(string, int32, int64, bool) error {
+	return nil
+}
+
+func (cgm *mockConsumerGroupManager) RecordReached(string, int32, int64) error {
+	return nil
+}
+
+func (cgm *mockConsumerGroupManager) ClearAttempts(string, int32) error {
+	return nil
+}
+
+func (cgm *mockConsumerGroupManager) FetchEndOffset(string, int32) (int64, error) {
+	return -1, nil
+}
+
+func (cgm *mockConsumerGroupManager) StoreEndOffset(topic string, partition int32, offset int64) (int64, error) {
+	return offset, nil
+}
+
+func (cgm *mockConsumerGroupManager) ClearEndOffsets() error {
+	return nil
+}
+
 func (cgm *mockConsumerGroupManager) Exists() (bool, error) {
 	return true, nil
 }
@@ -82,11 +101,30 @@ func (cgm *mockConsumerGroupManager) FetchOffset(string, int32) (int64, error) {
 	return 1, nil
 }
 
-func (cgm *mockConsumerGroupManager) WatchInstances() (kazoo.ConsumergroupInstanceList, <-chan zk.Event, error) {
+func (cgm *mockConsumerGroupManager) FetchOffsetVersion(string, int32) (int64, int32, error) {
+	return 1, 0, nil
+}
+
+func (cgm *mockConsumerGroupManager) PartitionEpoch(string, int32) (int32, error) {
+	return 0, nil
+}
+
+func (cgm *mockConsumerGroupManager) Instances() ([]*Member, error) {
+	return []*Member{
+		{ID: "test-instance-id"},
+		{ID: "test-instance-id2"},
+	}, nil
+}
+
+func (cgm *mockConsumerGroupManager) PartitionOwners() (map[string]map[int32]string, error) {
+	return map[string]map[int32]string{"Topic": {0: "test-instance-id2"}}, nil
+}
+
+func (cgm *mockConsumerGroupManager) WatchInstances() ([]*Member, <-chan zk.Event, error) {
 	ch := make(chan zk.Event, 1)
-	cgil := kazoo.ConsumergroupInstanceList{
-		&kazoo.ConsumergroupInstance{ID: "test-instance-id"},
-		&kazoo.ConsumergroupInstance{ID: "test-instance-id2"},
+	cgil := []*Member{
+		{ID: "test-instance-id"},
+		{ID: "test-instance-id2"},
 	}
 
 	// A delay in WatchInstances() gives enough time for cg.Close() to destroy all resources
@@ -110,8 +148,8 @@ func (cgim *mockConsumerGroupInstanceManager) Registered() (bool, error) {
 	return true, nil
 }
 
-func (cgim *mockConsumerGroupInstanceManager) ClaimPartition(topic string, partition int32) error {
-	return nil
+func (cgim *mockConsumerGroupInstanceManager) ClaimPartition(topic string, partition int32) (int32, error) {
+	return 0, nil
 }
 
 func (cgim *mockConsumerGroupInstanceManager) ReleasePartition(topic string, partition int32) error {
@@ -121,6 +159,10 @@ func (cgim *mockConsumerGroupInstanceManager) ReleasePartition(topic string, par
 type mockZookeeperTopicReader struct {
 }
 
+func (tr *mockZookeeperTopicReader) BrokerRacks() (map[int32]string, error) {
+	return nil, nil
+}
+
 func (tr *mockZookeeperTopicReader) Close() error {
 	// A delay here gives enough time for the panic to occur.
 	// If there is no delay the function that calls Close() is finished
@@ -131,7 +173,7 @@ func (tr *mockZookeeperTopicReader) Close() error {
 
 func (tr *mockZookeeperTopicReader) RetrievePartitionLeaders(partitions kazoo.PartitionList) (partitionLeaders, error) {
 	return partitionLeaders{
-		partitionLeader{id: 0, leader: 0, partition: &kazoo.Partition{ID: 0, Replicas: nil}},
+		&Partition{ID: 0, Leader: 0},
 	}, nil
 }
 
@@ -0,0 +1,128 @@
+package consumergroup
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// A Delivery is a message that must be acknowledged once it has been processed. Call Ack
+// when it was processed successfully, and Nack to have it delivered again. The offset of
+// a partition is never committed past a message that has not been acknowledged.
+type Delivery struct {
+	*sarama.ConsumerMessage
+	Attempts int // The number of times the message has been delivered, including this one.
+
+	deliveries *deliveries
+	claim      *pendingOffsets
+	settled    atomic.Bool
+}
+
+// Ack marks the message as processed. Only the first call to Ack or Nack has an effect.
+func (d *Delivery) Ack() {
+	if d.settled.CompareAndSwap(false, true) {
+		d.deliveries.completions.complete(d.ConsumerMessage, d.claim)
+		d.deliveries.cg.breaker.record(d.ConsumerMessage, true)
+	}
+}
+
+// Nack delivers the message again after requeueAfter. Other messages are delivered in the
+// meantime, but the offset of the partition is not committed past this message until it
+// is acknowledged. The message is not delivered again if this instance stops consuming
+// the partition in the meantime; the instance that consumes it next delivers it instead.
+// Only the first call to Ack or Nack has an effect.
+func (d *Delivery) Nack(requeueAfter time.Duration) {
+	if d.settled.CompareAndSwap(false, true) {
+		d.deliveries.cg.breaker.record(d.ConsumerMessage, false)
+		time.AfterFunc(requeueAfter, func() {
+			if !d.deliveries.cg.breaker.admit(d.deliveries.closed, nil, d.ConsumerMessage) {
+				return
+			}
+			select {
+			case d.deliveries.requeue <- d:
+			case <-d.deliveries.closed:
+			}
+		})
+	}
+}
+
+// Returns a channel that you can read to obtain the messages from Kafka to process as
+// deliveries that must be acknowledged. It is nil unless Config.Deliveries.Enabled is
+// set, in which case the Messages() channel must not be read.
+func (cg *ConsumerGroup) Deliveries() <-chan *Delivery {
+	if cg.deliveries == nil {
+		return nil
+	}
+	return cg.deliveries.out
+}
+
+// deliveries turns the messages of the consumer group into deliveries, and delivers
+// messages that were not acknowledged again.
+type deliveries struct {
+	cg          *ConsumerGroup
+	completions *completionTracker
+	out         chan *Delivery
+	requeue     chan *Delivery
+	closed      chan struct{}
+}
+
+func newDeliveries(cg *ConsumerGroup) *deliveries {
+	return &deliveries{
+		cg:          cg,
+		completions: newCompletionTracker(cg),
+		out:         make(chan *Delivery, cg.config.ChannelBufferSize),
+		requeue:     make(chan *Delivery),
+		closed:      make(chan struct{}),
+	}
+}
+
+// run delivers messages until the messages channel of the consumer group is closed, or
+// the consumer group is stopped.
+func (d *deliveries) run() {
+	defer close(d.closed)
+	defer close(d.out)
+
+	for {
+		select {
+		case message, ok := <-d.cg.messages:
+			if !ok {
+				return
+			}
+			claim, ok := d.completions.deliver(message)
+			if !ok {
+				continue
+			}
+			select {
+			case d.out <- &Delivery{ConsumerMessage: message, Attempts: 1, deliveries: d, claim: claim}:
+			case <-d.cg.stopper:
+				return
+			}
+
+		case delivery := <-d.requeue:
+			if !d.completions.pending(delivery.ConsumerMessage, delivery.claim) {
+				continue
+			}
+			select {
+			case d.out <- &Delivery{ConsumerMessage: delivery.ConsumerMessage, Attempts: delivery.Attempts + 1, deliveries: d, claim: delivery.claim}:
+			case <-d.cg.stopper:
+				return
+			}
+		}
+	}
+}
+
+// pending returns whether a message was delivered during the current claim of its
+// partition, and has not been processed yet.
+func (ct *completionTracker) pending(message *sarama.ConsumerMessage, claim *pendingOffsets) bool {
+	ct.l.Lock()
+	defer ct.l.Unlock()
+
+	pending := ct.partitions[message.Topic][message.Partition]
+	if pending == nil || pending != claim {
+		return false
+	}
+	_, found := slices.BinarySearch(pending.offsets, message.Offset)
+	return found && !pending.completed[message.Offset]
+}
@@ -0,0 +1,81 @@
+package consumergroup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestNackedMessagesAreRedelivered(t *testing.T) {
+	config := NewConfig()
+	config.Deliveries.Enabled = true
+	cg, _ := newMockConsumerGroup("DeliveriesConsumerGroup", []string{"Topic"}, nil, config)
+	if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+	tracker := cg.offsetManager.(*zookeeperOffsetManager).offsets["Topic"][0]
+	initial := tracker.highestProcessedOffset
+
+	go cg.deliveries.run()
+	for offset := int64(1); offset <= 3; offset++ {
+		cg.messages <- &sarama.ConsumerMessage{Topic: "Topic", Partition: 0, Offset: offset}
+	}
+
+	receive := func() *Delivery {
+		select {
+		case d := <-cg.Deliveries():
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for a delivery")
+			return nil
+		}
+	}
+
+	first := receive()
+	first.Nack(time.Millisecond)
+	receive().Ack()
+	receive().Ack()
+	if tracker.highestProcessedOffset != initial {
+		t.Errorf("Expected the commit position not to pass the nacked message, got %d", tracker.highestProcessedOffset)
+	}
+
+	again := receive()
+	if again.Offset != 1 || again.Attempts != 2 {
+		t.Fatalf("Expected offset 1 to be delivered a second time, got offset %d attempt %d", again.Offset, again.Attempts)
+	}
+	again.Ack()
+	first.Ack() // has no effect, the first delivery was already nacked
+	if tracker.highestProcessedOffset != 3 {
+		t.Errorf("Expected all offsets to be processed, got %d", tracker.highestProcessedOffset)
+	}
+
+	close(cg.messages)
+	if _, ok := <-cg.Deliveries(); ok {
+		t.Error("Expected the deliveries channel to be closed")
+	}
+}
+
+func TestDeliveriesStopWhenNotRead(t *testing.T) {
+	config := NewConfig()
+	config.Deliveries.Enabled = true
+	config.ChannelBufferSize = 1
+	cg, _ := newMockConsumerGroup("DeliveriesConsumerGroup", []string{"Topic"}, nil, config)
+	if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	go cg.deliveries.run()
+	for offset := int64(1); offset <= 3; offset++ {
+		cg.messages <- &sarama.ConsumerMessage{Topic: "Topic", Partition: 0, Offset: offset}
+	}
+	(<-cg.Deliveries()).Nack(time.Millisecond)
+
+	// Nobody reads the deliveries anymore, so run is blocked until the consumer group stops.
+	close(cg.stopper)
+	select {
+	case <-cg.deliveries.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the deliveries to stop when the consumer group is stopped")
+	}
+}
@@ -0,0 +1,124 @@
+package consumergroup
+
+import (
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// leaderElection elects a single leader among the instances of a consumer group.
+type leaderElection interface {
+	Volunteer(id string) (string, error)
+	WatchCandidate(candidate string) (bool, <-chan zk.Event, error)
+	Withdraw(candidate string) error
+	Leader() (string, error)
+}
+
+// Leader returns the ID of the instance that currently leads the consumer group, or ""
+// if no instance is a candidate. It returns ElectionDisabled unless
+// Config.Leadership.Enabled is set.
+func (cg *ConsumerGroup) Leader() (string, error) {
+	if cg.election == nil {
+		return "", ElectionDisabled
+	}
+	return cg.election.Leader()
+}
+
+// IsLeader returns whether this instance currently leads the consumer group. An
+// instance stops considering itself the leader as soon as it is disconnected from
+// Zookeeper, because its session may expire without it knowing.
+func (cg *ConsumerGroup) IsLeader() bool {
+	return cg.leading.Load()
+}
+
+// runElection keeps this instance a candidate in the leader election until the consumer
+// group closes, and tracks whether it leads. After the session expired, the candidate
+// node is gone and the instance volunteers again with the new session.
+func (cg *ConsumerGroup) runElection() {
+	defer cg.background.Done()
+
+	var (
+		candidate string
+		changes   <-chan zk.Event
+		retry     <-chan time.Time
+		failures  int
+	)
+
+	recheck := true
+	for {
+		if recheck {
+			changes, retry = nil, nil
+
+			var (
+				leading bool
+				err     error
+			)
+			if candidate == "" {
+				candidate, err = cg.election.Volunteer(cg.instanceID)
+			}
+			if err == nil {
+				leading, changes, err = cg.election.WatchCandidate(candidate)
+			}
+
+			if err == zk.ErrNoNode {
+				cg.Logf("Lost leader election candidacy, volunteering again\n")
+				cg.setLeader(false)
+				candidate = ""
+				continue
+			} else if err != nil {
+				failures++
+				cg.Logf("FAILED to run leader election: %s\n", err)
+				cg.setLeader(false)
+				retry = time.After(cg.backoff(failures))
+			} else {
+				failures = 0
+				cg.setLeader(leading)
+			}
+		}
+
+		select {
+		case <-cg.stopper:
+			cg.setLeader(false)
+			if candidate != "" {
+				if err := cg.election.Withdraw(candidate); err != nil {
+					cg.Logf("FAILED to withdraw from leader election: %s\n", err)
+				}
+			}
+			return
+		case <-changes:
+			recheck = true
+		case <-retry:
+			recheck = true
+		case event := <-cg.electionEvents:
+			switch event.State {
+			case zk.StateDisconnected:
+				cg.setLeader(false)
+				recheck = false
+			case zk.StateHasSession:
+				recheck = true
+			default:
+				recheck = false
+			}
+		}
+	}
+}
+
+// setLeader records whether this instance leads the consumer group, and calls the
+// callbacks when that changed.
+func (cg *ConsumerGroup) setLeader(leading bool) {
+	if cg.leading.Swap(leading) == leading {
+		return
+	}
+
+	if leading {
+		cg.Logf("Elected as leader of the consumer group\n")
+		if cg.config.Leadership.OnElected != nil {
+			cg.config.Leadership.OnElected()
+		}
+	} else {
+		cg.Logf("No longer the leader of the consumer group\n")
+		if cg.config.Leadership.OnRevoked != nil {
+			cg.config.Leadership.OnRevoked()
+		}
+	}
+}
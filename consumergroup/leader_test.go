@@ -0,0 +1,122 @@
+package consumergroup
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// fakeElection is a leader election in which a single candidate leads until it is taken
+// away, as happens when its session expires.
+type fakeElection struct {
+	l         sync.Mutex
+	next      int
+	leader    string
+	withdrawn []string
+	changes   chan zk.Event
+}
+
+func (e *fakeElection) Volunteer(id string) (string, error) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.next++
+	e.leader = "candidate-" + string(rune('0'+e.next))
+	return e.leader, nil
+}
+
+func (e *fakeElection) WatchCandidate(candidate string) (bool, <-chan zk.Event, error) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	if candidate != e.leader {
+		return false, nil, zk.ErrNoNode
+	}
+	return true, e.changes, nil
+}
+
+func (e *fakeElection) Withdraw(candidate string) error {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.withdrawn = append(e.withdrawn, candidate)
+	return nil
+}
+
+func (e *fakeElection) Leader() (string, error) {
+	return "test-instance-id", nil
+}
+
+// expire removes the candidate node of the leader, like Zookeeper does when its session
+// expires.
+func (e *fakeElection) expire() {
+	e.l.Lock()
+	e.leader = ""
+	e.l.Unlock()
+	e.changes <- zk.Event{Type: zk.EventNotWatching, Err: zk.ErrSessionExpired}
+}
+
+func TestLeaderElectionSurvivesSessionExpiry(t *testing.T) {
+	elected := make(chan struct{}, 10)
+	revoked := make(chan struct{}, 10)
+
+	config := NewConfig()
+	config.Leadership.Enabled = true
+	config.Leadership.OnElected = func() { elected <- struct{}{} }
+	config.Leadership.OnRevoked = func() { revoked <- struct{}{} }
+
+	election := &fakeElection{changes: make(chan zk.Event, 1)}
+	consumer, err := JoinConsumerGroup(
+		"LeaderConsumerGroup",
+		[]string{"Topic"},
+		[]string{"localhost:2181"},
+		config,
+		func(name string, topics []string, zookeeper []string, config *Config) (*ConsumerGroup, error) {
+			cg, err := newMockConsumerGroup(name, topics, zookeeper, config)
+			if err == nil {
+				cg.election = election
+				cg.electionEvents = make(chan zk.Event, 1)
+			}
+			return cg, err
+		})
+	if err != nil {
+		t.Fatal("Could not start consumer")
+	}
+
+	expect := func(c chan struct{}, what string) {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the instance to be %s", what)
+		}
+	}
+
+	expect(elected, "elected")
+	if !consumer.IsLeader() {
+		t.Error("Expected IsLeader to report the leadership")
+	}
+	if leader, err := consumer.Leader(); err != nil || leader != "test-instance-id" {
+		t.Errorf("Unexpected leader: %q, %v", leader, err)
+	}
+
+	election.expire()
+	expect(revoked, "revoked after the session expired")
+	expect(elected, "elected again with a new candidacy")
+
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expect(revoked, "revoked when closing")
+	if consumer.IsLeader() {
+		t.Error("Expected IsLeader to be false after closing")
+	}
+	if len(election.withdrawn) != 1 || election.withdrawn[0] != "candidate-2" {
+		t.Errorf("Expected the second candidacy to be withdrawn, got %v", election.withdrawn)
+	}
+}
+
+func TestLeaderRequiresElection(t *testing.T) {
+	cg, _ := newMockConsumerGroup("LeaderConsumerGroup", []string{"Topic"}, []string{"localhost:2181"}, nil)
+	if _, err := cg.Leader(); err != ElectionDisabled {
+		t.Errorf("Expected ElectionDisabled, got %v", err)
+	}
+}
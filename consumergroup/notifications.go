@@ -0,0 +1,233 @@
+package consumergroup
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Notification describes an event in the lifecycle of a consumer group instance. It
+// is one of the notification types below. Notifications are only sent when
+// Config.Notifications.Enabled is set, in which case Notifications() must be read.
+type Notification interface {
+	notification()
+}
+
+// RebalanceStart is sent when the partitions are about to be divided between the
+// registered instances, leaving out the standby instances that are not needed.
+type RebalanceStart struct {
+	Instances []string // The IDs of the instances the partitions are divided between.
+}
+
+// RebalanceEnd is sent once this instance knows which partitions it should consume.
+// Claiming them may take a while if other instances are still processing them. It is
+// also sent when the rebalance was cancelled, e.g. because the partitions of a topic
+// could not be listed, in which case another rebalance follows unless the consumer
+// group is closing.
+type RebalanceEnd struct {
+	Assignment map[string][]int32 // The partitions assigned to this instance, by topic.
+	Cancelled  bool               // Whether some topics were not assigned because the rebalance was cancelled.
+}
+
+// PartitionClaimed is sent when this instance has claimed a partition and is about to
+// start consuming it. Broadcast and shadow instances consume partitions without claiming
+// them, so they do not send it.
+type PartitionClaimed struct {
+	Topic     string
+	Partition int32
+}
+
+// PartitionReleased is sent when this instance stopped consuming a partition and released
+// its claim. It is not sent when the claim was lost, e.g. because the Zookeeper session
+// expired or another instance claimed the partition in the meantime.
+type PartitionReleased struct {
+	Topic      string
+	Partition  int32
+	LastOffset int64 // The last offset that was delivered, or -1 if none was.
+}
+
+// OffsetReset is sent when the offset to resume from was not available anymore, and
+// consumption of the partition continued from another offset.
+type OffsetReset struct {
+	Topic     string
+	Partition int32
+	OldOffset int64 // The offset that could not be consumed.
+	NewOffset int64 // The offset consumption continued from.
+}
+
+// DataLoss is sent when messages of a partition were skipped, because the offset to
+// resume from was not available anymore and consumption continued from a later offset.
+// The messages from From up to, but not including, To were never delivered. Without
+// Config.Notifications.Enabled, data loss is only logged and counted in the
+// consumergroup-lost-messages metric.
+type DataLoss struct {
+	Topic     string
+	Partition int32
+	From      int64 // The first offset that was skipped.
+	To        int64 // The offset consumption continued from.
+}
+
+// RetentionRisk is sent when the committed offset of a partition this instance consumes
+// is expected to be removed by retention within Config.Retention.Margin, at the rate
+// messages are currently produced. It is sent on every check until the risk is gone.
+type RetentionRisk struct {
+	Topic     string
+	Partition int32
+	Committed int64         // The committed offset of the partition.
+	Oldest    int64         // The oldest offset that is still available.
+	Remaining time.Duration // The expected time until the committed offset is removed, or 0 if it already was.
+}
+
+// PoisonMessage is sent when a message was skipped, because consuming its partition
+// started from its offset more than Config.Poison.MaxAttempts times.
+type PoisonMessage struct {
+	Topic           string
+	Partition       int32
+	Offset          int64
+	Attempts        int    // The number of attempts to consume the message that failed.
+	DeadLetterTopic string // The topic the message was produced to, if any.
+}
+
+// BreakerStateChanged is sent when the circuit breaker opens, closes, or becomes
+// half-open to probe whether processing works again.
+type BreakerStateChanged struct {
+	State BreakerState
+}
+
+// PartitionFinished is sent when a partition reached its end offset with Config.Bounded,
+// and its offset was committed.
+type PartitionFinished struct {
+	Topic      string
+	Partition  int32
+	LastOffset int64 // The last offset that was delivered, or -1 if none was.
+}
+
+// CommitFailed is sent when an offset could not be committed. The offset committer does
+// not wait for it to be read, so it may arrive after later notifications.
+type CommitFailed struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
+// MembershipChanged is sent when the list of registered instances has changed.
+type MembershipChanged struct {
+	Instances []string // The IDs of the instances that are currently registered.
+}
+
+func (*RebalanceStart) notification()      {}
+func (*RebalanceEnd) notification()        {}
+func (*PartitionClaimed) notification()    {}
+func (*PartitionReleased) notification()   {}
+func (*OffsetReset) notification()         {}
+func (*DataLoss) notification()            {}
+func (*RetentionRisk) notification()       {}
+func (*PoisonMessage) notification()       {}
+func (*BreakerStateChanged) notification() {}
+func (*PartitionFinished) notification()   {}
+func (*CommitFailed) notification()        {}
+func (*MembershipChanged) notification()   {}
+
+// Returns a channel that you can read to obtain lifecycle notifications of the consumer
+// group. It is nil unless Config.Notifications.Enabled is set.
+func (cg *ConsumerGroup) Notifications() <-chan Notification {
+	return cg.notifications
+}
+
+// notifyLater sends a notification without waiting for it to be read, for callers that
+// must not be held up by the application, like the offset committer.
+func (cg *ConsumerGroup) notifyLater(n Notification) {
+	if cg.notifications != nil {
+		go cg.notify(n)
+	}
+}
+
+// notify sends a notification, waiting until it is read or the consumer group closes.
+func (cg *ConsumerGroup) notify(n Notification) {
+	if cg.notifications == nil {
+		return
+	}
+
+	cg.notificationsMu.RLock()
+	defer cg.notificationsMu.RUnlock()
+	if cg.notificationsClosed {
+		return
+	}
+
+	select {
+	case cg.notifications <- n:
+	case <-cg.stopper:
+	}
+}
+
+func (cg *ConsumerGroup) closeNotifications() {
+	if cg.notifications == nil {
+		return
+	}
+
+	cg.notificationsMu.Lock()
+	defer cg.notificationsMu.Unlock()
+	cg.notificationsClosed = true
+	close(cg.notifications)
+}
+
+// assignment collects the partitions the topic consumers of a rebalance have been
+// assigned, and sends RebalanceEnd once every topic has reported.
+type assignment struct {
+	cg         *ConsumerGroup
+	l          sync.Mutex
+	pending    int
+	cancelled  bool
+	partitions map[string][]int32
+	finished   map[string]map[int32]bool // The partitions that reached their end with Config.Bounded.
+}
+
+func newAssignment(cg *ConsumerGroup, topics int) *assignment {
+	return &assignment{cg: cg, pending: topics, partitions: make(map[string][]int32)}
+}
+
+func (a *assignment) add(topic string, partitions []int32) {
+	a.l.Lock()
+	a.partitions[topic] = partitions
+	a.pending--
+	complete := a.pending == 0
+	finished := complete && !a.cancelled && a.cg.config.Bounded.Enabled && a.allFinished()
+	a.l.Unlock()
+
+	if complete {
+		a.cg.notify(&RebalanceEnd{Assignment: a.partitions, Cancelled: a.cancelled})
+	}
+	if finished {
+		a.cg.allPartitionsFinished()
+	}
+}
+
+// cancel records that the topic consumer of a topic stopped before it was assigned
+// partitions. It does nothing if the topic was assigned partitions.
+func (a *assignment) cancel(topic string) {
+	a.l.Lock()
+	if _, ok := a.partitions[topic]; ok {
+		a.l.Unlock()
+		return
+	}
+	a.partitions[topic] = nil
+	a.pending--
+	a.cancelled = true
+	complete := a.pending == 0
+	a.l.Unlock()
+
+	if complete {
+		a.cg.notify(&RebalanceEnd{Assignment: a.partitions, Cancelled: true})
+	}
+}
+
+// instanceIDs returns the sorted IDs of a list of instances.
+func instanceIDs(consumers []*Member) []string {
+	var ids []string
+	for _, consumer := range consumers {
+		ids = append(ids, consumer.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
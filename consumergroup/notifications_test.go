@@ -0,0 +1,199 @@
+package consumergroup
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// changingConsumerGroupManager has a single instance, and reports a change of the
+// instances whenever the test sends one.
+type changingConsumerGroupManager struct {
+	mockConsumerGroupManager
+	changes chan zk.Event
+}
+
+func (cgm *changingConsumerGroupManager) WatchInstances() ([]*Member, <-chan zk.Event, error) {
+	return []*Member{{ID: "test-instance-id"}}, cgm.changes, nil
+}
+
+func expectNotification(t *testing.T, consumer *ConsumerGroup, expected Notification) {
+	t.Helper()
+	select {
+	case n := <-consumer.Notifications():
+		if !reflect.DeepEqual(n, expected) {
+			t.Errorf("Expected %#v, got %#v", expected, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for %#v", expected)
+	}
+}
+
+func TestRebalanceNotifications(t *testing.T) {
+	config := NewConfig()
+	config.Notifications.Enabled = true
+
+	consumer, err := JoinConsumerGroup(
+		"NotificationsConsumerGroup",
+		[]string{"Topic"},
+		[]string{"localhost:2181"},
+		config,
+		newMockConsumerGroup)
+	if err != nil {
+		t.Fatal("Could not start consumer")
+	}
+	defer consumer.Close()
+
+	expected := []string{"test-instance-id", "test-instance-id2"}
+	for _, check := range []func(Notification) bool{
+		func(n Notification) bool {
+			mc, ok := n.(*MembershipChanged)
+			return ok && slices.Equal(mc.Instances, expected)
+		},
+		func(n Notification) bool {
+			rs, ok := n.(*RebalanceStart)
+			return ok && slices.Equal(rs.Instances, expected)
+		},
+	} {
+		select {
+		case n := <-consumer.Notifications():
+			if !check(n) {
+				t.Errorf("Unexpected notification: %#v", n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for notification")
+		}
+	}
+}
+
+type standbyConsumerGroupManager struct {
+	mockConsumerGroupManager
+}
+
+func (cgm *standbyConsumerGroupManager) WatchInstances() ([]*Member, <-chan zk.Event, error) {
+	return []*Member{
+		{ID: "test-instance-id"},
+		{ID: "standby-instance-id", Standby: true, activeInstances: 1},
+	}, make(chan zk.Event), nil
+}
+
+func TestRebalanceStartLeavesOutStandbys(t *testing.T) {
+	config := NewConfig()
+	config.Notifications.Enabled = true
+
+	consumer, err := JoinConsumerGroup(
+		"NotificationsConsumerGroup",
+		[]string{"Topic"},
+		[]string{"localhost:2181"},
+		config,
+		func(name string, topics []string, zookeeper []string, config *Config) (*ConsumerGroup, error) {
+			cg, err := newMockConsumerGroup(name, topics, zookeeper, config)
+			if err == nil {
+				cg.group = &standbyConsumerGroupManager{}
+			}
+			return cg, err
+		})
+	if err != nil {
+		t.Fatal("Could not start consumer")
+	}
+	defer consumer.Close()
+
+	expectNotification(t, consumer, &MembershipChanged{Instances: []string{"standby-instance-id", "test-instance-id"}})
+	expectNotification(t, consumer, &RebalanceStart{Instances: []string{"test-instance-id"}})
+}
+
+func TestPartitionNotifications(t *testing.T) {
+	config := NewConfig()
+	config.Notifications.Enabled = true
+	group := &changingConsumerGroupManager{changes: make(chan zk.Event, 1)}
+
+	consumer, err := JoinConsumerGroup(
+		"NotificationsConsumerGroup",
+		[]string{"Topic"},
+		[]string{"localhost:2181"},
+		config,
+		func(name string, topics []string, zookeeper []string, config *Config) (*ConsumerGroup, error) {
+			cg, err := newMockConsumerGroup(name, topics, zookeeper, config)
+			if err == nil {
+				cg.consumer = &idleConsumer{}
+				cg.kazoo = &partitionTopicReader{}
+				cg.group = group
+			}
+			return cg, err
+		})
+	if err != nil {
+		t.Fatal("Could not start consumer")
+	}
+	defer consumer.Close()
+
+	instances := []string{"test-instance-id"}
+	expectNotification(t, consumer, &MembershipChanged{Instances: instances})
+	expectNotification(t, consumer, &RebalanceStart{Instances: instances})
+	expectNotification(t, consumer, &RebalanceEnd{Assignment: map[string][]int32{"Topic": {0}}})
+	expectNotification(t, consumer, &PartitionClaimed{Topic: "Topic", Partition: 0})
+
+	group.changes <- zk.Event{Type: zk.EventNodeChildrenChanged}
+	expectNotification(t, consumer, &PartitionReleased{Topic: "Topic", Partition: 0, LastOffset: -1})
+	expectNotification(t, consumer, &RebalanceStart{Instances: instances})
+}
+
+func TestCancelledRebalanceNotification(t *testing.T) {
+	config := NewConfig()
+	config.Notifications.Enabled = true
+
+	// The partitions of the topic cannot be listed, which cancels every rebalance.
+	consumer, err := JoinConsumerGroup(
+		"NotificationsConsumerGroup",
+		[]string{"Topic"},
+		[]string{"localhost:2181"},
+		config,
+		newMockConsumerGroup)
+	if err != nil {
+		t.Fatal("Could not start consumer")
+	}
+	defer consumer.Close()
+
+	instances := []string{"test-instance-id", "test-instance-id2"}
+	expectNotification(t, consumer, &MembershipChanged{Instances: instances})
+	expectNotification(t, consumer, &RebalanceStart{Instances: instances})
+	expectNotification(t, consumer, &RebalanceEnd{Assignment: map[string][]int32{"Topic": nil}, Cancelled: true})
+	expectNotification(t, consumer, &RebalanceStart{Instances: instances})
+}
+
+func TestBroadcastSendsNoPartitionNotifications(t *testing.T) {
+	config := NewConfig()
+	config.Notifications.Enabled = true
+	config.Broadcast.Enabled = true
+
+	consumer, err := JoinConsumerGroup(
+		"NotificationsConsumerGroup",
+		[]string{"Topic"},
+		[]string{"localhost:2181"},
+		config,
+		func(name string, topics []string, zookeeper []string, config *Config) (*ConsumerGroup, error) {
+			cg, err := newMockConsumerGroup(name, topics, zookeeper, config)
+			if err == nil {
+				cg.consumer = &idleConsumer{}
+				cg.kazoo = &partitionTopicReader{}
+			}
+			return cg, err
+		})
+	if err != nil {
+		t.Fatal("Could not start consumer")
+	}
+
+	// The partitions are consumed right away, as there is nothing to claim.
+	time.Sleep(200 * time.Millisecond)
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for n := range consumer.Notifications() {
+		switch n.(type) {
+		case *PartitionClaimed, *PartitionReleased:
+			t.Errorf("Unexpected notification for a partition that was never claimed: %#v", n)
+		}
+	}
+}
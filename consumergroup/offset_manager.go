@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/rcrowley/go-metrics"
 )
 
 // OffsetManager is the main interface consumergroup requires to manage offsets of the consumergroup.
@@ -45,14 +47,64 @@ type OffsetManager interface {
 	Close() error
 }
 
+// partitionDiscarder is implemented by offset managers that can forget about a partition
+// without committing its outstanding offsets.
+type partitionDiscarder interface {
+	// DiscardPartition is called instead of FinalizePartition when the consumergroup lost
+	// its claim on a partition, e.g. because its Zookeeper session expired. Another
+	// instance may already be consuming the partition, so the offset manager must forget
+	// about it without committing any outstanding offsets.
+	DiscardPartition(topic string, partition int32)
+}
+
+// attemptTracker is implemented by offset managers that can commit every processed offset
+// of a partition right away.
+type attemptTracker interface {
+	// TrackAttempts is called when an earlier attempt to consume a partition did not end
+	// cleanly. Every processed offset of the partition is committed right away, and the
+	// attempts to consume it are moved forward with it, so that the next attempt counts
+	// against the message this attempt fails on. Once the offset until which the earlier
+	// attempt received messages is committed, offsets are committed periodically again.
+	// An until of -1 tracks the attempts until the partition is finalized.
+	TrackAttempts(topic string, partition int32, until int64)
+
+	// MarkAsReceived tells the offset manager that the partition consumer received a
+	// message, so that the next attempt knows how far this one got if it does not end
+	// cleanly.
+	MarkAsReceived(topic string, partition int32, offset int64)
+}
+
 var (
 	UncleanClose = errors.New("Not all offsets were committed before shutdown was completed")
+
+	// offsetChanged is returned by a commit that expected another version of the stored offset.
+	offsetChanged = errors.New("The stored offset was changed by another instance")
 )
 
+// maxRegressionChecks is how many times a commit checks for a regression again when the
+// stored offset changed between the check and the commit.
+const maxRegressionChecks = 3
+
+// RegressionPolicy decides what happens to a commit that would move the stored offset
+// of a partition backwards.
+type RegressionPolicy int
+
+const (
+	RegressionAllow  RegressionPolicy = iota // Commit the offset without checking the stored offset.
+	RegressionWarn                           // Commit the offset, but log and count the regression.
+	RegressionReject                         // Log and count the regression, and keep the stored offset.
+)
+
+func (p RegressionPolicy) valid() bool {
+	return p >= RegressionAllow && p <= RegressionReject
+}
+
 // OffsetManagerConfig holds configuration setting son how the offset manager should behave.
 type OffsetManagerConfig struct {
-	CommitInterval time.Duration // Interval between offset flushes to the backend store.
-	VerboseLogging bool          // Whether to enable verbose logging.
+	CommitInterval time.Duration    // Interval between offset flushes to the backend store.
+	VerboseLogging bool             // Whether to enable verbose logging.
+	Regression     RegressionPolicy // What to do with commits that would move the stored offset backwards.
+	ReadOnly       bool             // Whether processed offsets are only tracked, and never stored.
 }
 
 // NewOffsetManagerConfig returns a new OffsetManagerConfig with sane defaults.
@@ -73,7 +125,12 @@ type partitionOffsetTracker struct {
 	waitingForOffset       int64
 	highestProcessedOffset int64
 	lastCommittedOffset    int64
+	epoch                  int32
 	done                   chan struct{}
+	trackAttempts          bool
+	trackUntil             int64 // The last offset to commit right away, or -1 for all of them.
+	receivedOffset         int64
+	reachedOffset          int64 // The received offset that is stored with the attempts.
 }
 
 type zookeeperOffsetManager struct {
@@ -84,6 +141,10 @@ type zookeeperOffsetManager struct {
 
 	closing, closed, flush chan struct{}
 	flushErr               chan error
+
+	// Receives a signal when an offset of a partition whose attempts are tracked was
+	// processed.
+	processed chan struct{}
 }
 
 // NewZookeeperOffsetManager returns an offset manager that uses Zookeeper
@@ -101,6 +162,8 @@ func NewZookeeperOffsetManager(cg *ConsumerGroup, config *OffsetManagerConfig) O
 		closed:   make(chan struct{}),
 		flush:    make(chan struct{}),
 		flushErr: make(chan error),
+
+		processed: make(chan struct{}, 1),
 	}
 
 	go zom.offsetCommitter()
@@ -124,7 +187,10 @@ func (zom *zookeeperOffsetManager) InitializePartition(topic string, partition i
 	zom.offsets[topic][partition] = &partitionOffsetTracker{
 		highestProcessedOffset: nextOffset - 1,
 		lastCommittedOffset:    nextOffset - 1,
+		epoch:                  zom.cg.claimEpoch(topic, partition),
 		done:                   make(chan struct{}),
+		receivedOffset:         nextOffset - 1,
+		reachedOffset:          nextOffset - 1,
 	}
 
 	return nextOffset, nil
@@ -136,14 +202,21 @@ func (zom *zookeeperOffsetManager) FinalizePartition(topic string, partition int
 	zom.l.RUnlock()
 
 	if lastOffset >= 0 {
-		if lastOffset-tracker.highestProcessedOffset > 0 {
-			zom.cg.Logf("%s/%d :: Last processed offset: %d. Waiting up to %ds for another %d messages to process...", topic, partition, tracker.highestProcessedOffset, timeout/time.Second, lastOffset-tracker.highestProcessedOffset)
+		tracker.l.Lock()
+		processed := tracker.highestProcessedOffset
+		tracker.l.Unlock()
+
+		if lastOffset-processed > 0 {
+			zom.cg.Logf("%s/%d :: Last processed offset: %d. Waiting up to %ds for another %d messages to process...", topic, partition, processed, timeout/time.Second, lastOffset-processed)
 			if !tracker.waitForOffset(lastOffset, timeout) {
 				return fmt.Errorf("TIMEOUT waiting for offset %d. Last committed offset: %d", lastOffset, tracker.lastCommittedOffset)
 			}
 		}
 
-		if err := zom.commitOffset(topic, partition, tracker); err != nil {
+		if err := zom.commitOffset(topic, partition, tracker); err == ErrPartitionFenced {
+			zom.DiscardPartition(topic, partition)
+			return err
+		} else if err != nil {
 			return fmt.Errorf("FAILED to commit offset %d to Zookeeper. Last committed offset: %d", tracker.highestProcessedOffset, tracker.lastCommittedOffset)
 		}
 	}
@@ -155,14 +228,48 @@ func (zom *zookeeperOffsetManager) FinalizePartition(topic string, partition int
 	return nil
 }
 
+func (zom *zookeeperOffsetManager) DiscardPartition(topic string, partition int32) {
+	zom.l.Lock()
+	delete(zom.offsets[topic], partition)
+	zom.l.Unlock()
+}
+
 func (zom *zookeeperOffsetManager) MarkAsProcessed(topic string, partition int32, offset int64) bool {
 	zom.l.RLock()
 	defer zom.l.RUnlock()
-	if p, ok := zom.offsets[topic][partition]; ok {
-		return p.markAsProcessed(offset)
-	} else {
+	p, ok := zom.offsets[topic][partition]
+	if !ok || !p.markAsProcessed(offset) {
 		return false
 	}
+
+	if p.tracksAttempts() {
+		// The offset committer commits the offset, so that processing is not held up.
+		select {
+		case zom.processed <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+func (zom *zookeeperOffsetManager) TrackAttempts(topic string, partition int32, until int64) {
+	zom.l.RLock()
+	defer zom.l.RUnlock()
+	if p, ok := zom.offsets[topic][partition]; ok {
+		p.l.Lock()
+		p.trackAttempts, p.trackUntil = true, until
+		p.l.Unlock()
+	}
+}
+
+func (zom *zookeeperOffsetManager) MarkAsReceived(topic string, partition int32, offset int64) {
+	zom.l.RLock()
+	defer zom.l.RUnlock()
+	if p, ok := zom.offsets[topic][partition]; ok {
+		p.l.Lock()
+		p.receivedOffset = max(p.receivedOffset, offset)
+		p.l.Unlock()
+	}
 }
 
 func (zom *zookeeperOffsetManager) Flush() error {
@@ -206,6 +313,8 @@ func (zom *zookeeperOffsetManager) offsetCommitter() {
 			}
 		case <-zom.flush:
 			zom.flushErr <- zom.commitOffsets()
+		case <-zom.processed:
+			zom.commitTrackedOffsets()
 		}
 	}
 }
@@ -217,10 +326,17 @@ func (zom *zookeeperOffsetManager) commitOffsets() error {
 	var returnErr error
 	for topic, partitionOffsets := range zom.offsets {
 		for partition, offsetTracker := range partitionOffsets {
-			err := zom.commitOffset(topic, partition, offsetTracker)
+			var err error
+			if offsetTracker.tracksAttempts() {
+				err = zom.advanceAttempts(topic, partition, offsetTracker)
+			} else {
+				err = zom.commitOffset(topic, partition, offsetTracker)
+			}
 			switch err {
 			case nil:
-				// noop
+				zom.recordReached(topic, partition, offsetTracker)
+			case ErrPartitionFenced:
+				// noop, the partition consumer reports that it has been fenced
 			default:
 				returnErr = err
 			}
@@ -229,16 +345,100 @@ func (zom *zookeeperOffsetManager) commitOffsets() error {
 	return returnErr
 }
 
+// commitTrackedOffsets commits the processed offsets of the partitions whose attempts are
+// tracked. Errors are left for the next periodic commit to report.
+func (zom *zookeeperOffsetManager) commitTrackedOffsets() {
+	zom.l.RLock()
+	defer zom.l.RUnlock()
+
+	for topic, partitionOffsets := range zom.offsets {
+		for partition, offsetTracker := range partitionOffsets {
+			if offsetTracker.tracksAttempts() {
+				_ = zom.advanceAttempts(topic, partition, offsetTracker)
+			}
+		}
+	}
+}
+
+// advanceAttempts commits the processed offset of a partition whose attempts are tracked,
+// and moves the attempts forward with it. Tracking stops once the committed offset passed
+// the offset until which the earlier attempt received messages, because the message that
+// attempt failed on was processed then.
+func (zom *zookeeperOffsetManager) advanceAttempts(topic string, partition int32, tracker *partitionOffsetTracker) error {
+	if err := zom.commitOffset(topic, partition, tracker); err != nil {
+		return err
+	}
+
+	tracker.l.Lock()
+	committed := tracker.lastCommittedOffset
+	passed := tracker.trackAttempts && tracker.trackUntil >= 0 && committed >= tracker.trackUntil
+	if passed {
+		tracker.trackAttempts = false
+	}
+	tracker.l.Unlock()
+
+	if err := zom.cg.group.AdvanceAttempts(topic, partition, committed+1, !passed); err != nil {
+		zom.cg.Logf("%s/%d :: FAILED to record the attempt to consume from offset %d: %s\n", topic, partition, committed+1, err)
+	}
+	if passed {
+		zom.cg.Logf("%s/%d :: Processed every message up to offset %d, committing offsets periodically again.\n", topic, partition, committed)
+	}
+	return nil
+}
+
+// recordReached stores the highest offset the partition consumer received with the
+// attempts to consume the partition, if it changed.
+func (zom *zookeeperOffsetManager) recordReached(topic string, partition int32, tracker *partitionOffsetTracker) {
+	tracker.l.Lock()
+	received, reached := tracker.receivedOffset, tracker.reachedOffset
+	tracker.l.Unlock()
+	if received <= reached {
+		return
+	}
+
+	if err := zom.cg.group.RecordReached(topic, partition, received); err != nil {
+		zom.cg.Logf("%s/%d :: FAILED to record that offset %d was received: %s\n", topic, partition, received, err)
+		return
+	}
+	tracker.l.Lock()
+	tracker.reachedOffset = received
+	tracker.l.Unlock()
+}
+
 func (zom *zookeeperOffsetManager) commitOffset(topic string, partition int32, tracker *partitionOffsetTracker) error {
 	err := tracker.commit(func(offset int64) error {
-		if offset >= 0 {
-			return zom.cg.group.CommitOffset(topic, partition, offset+1)
-		} else {
+		if offset < 0 || zom.config.ReadOnly {
 			return nil
 		}
+
+		if zom.config.Regression == RegressionAllow {
+			return zom.cg.group.CommitOffset(topic, partition, offset+1, tracker.epoch, -1)
+		}
+
+		// The offset is only stored if nobody changed it since it was checked.
+		for attempt := 1; ; attempt++ {
+			keep, version, err := zom.checkRegression(topic, partition, offset+1)
+			if err != nil {
+				return err
+			} else if keep {
+				return nil
+			}
+
+			err = zom.cg.group.CommitOffset(topic, partition, offset+1, tracker.epoch, version)
+			if err != offsetChanged || attempt == maxRegressionChecks {
+				return err
+			}
+		}
 	})
 
 	if err != nil {
+		zom.cg.notifyLater(&CommitFailed{Topic: topic, Partition: partition, Offset: tracker.highestProcessedOffset, Err: err})
+	}
+
+	if err == ErrPartitionFenced {
+		zom.cg.Logf("FAILED to commit offset %d for %s/%d: the partition has been claimed by another instance!", tracker.highestProcessedOffset, topic, partition)
+		zom.cg.fencePartition(topic, partition)
+	} else if err != nil {
 		zom.cg.Logf("FAILED to commit offset %d for %s/%d!", tracker.highestProcessedOffset, topic, partition)
 	} else if zom.config.VerboseLogging {
 		zom.cg.Logf("Committed offset %d for %s/%d!", tracker.lastCommittedOffset, topic, partition)
@@ -247,6 +447,35 @@ func (zom *zookeeperOffsetManager) commitOffset(topic string, partition int32, t
 	return err
 }
 
+// checkRegression compares the offset that is about to be committed with the offset that
+// is currently stored, and returns true if the stored offset should be kept. It also
+// returns the version of the stored offset, to commit only if it did not change since.
+func (zom *zookeeperOffsetManager) checkRegression(topic string, partition int32, nextOffset int64) (bool, int32, error) {
+	storedOffset, version, err := zom.cg.group.FetchOffsetVersion(topic, partition)
+	if err != nil {
+		return false, -1, err
+	}
+	if nextOffset >= storedOffset {
+		return false, version, nil
+	}
+
+	metrics.GetOrRegisterCounter("consumergroup-offset-regressions", zom.cg.config.MetricRegistry).Inc(1)
+	if zom.config.Regression == RegressionReject {
+		zom.cg.Logf("%s/%d :: REFUSED to move the stored offset back from %d to %d!", topic, partition, storedOffset, nextOffset)
+		return true, version, nil
+	}
+
+	zom.cg.Logf("%s/%d :: Moving the stored offset back from %d to %d!", topic, partition, storedOffset, nextOffset)
+	return false, version, nil
+}
+
+// tracksAttempts returns whether every processed offset is committed right away.
+func (pot *partitionOffsetTracker) tracksAttempts() bool {
+	pot.l.Lock()
+	defer pot.l.Unlock()
+	return pot.trackAttempts
+}
+
 // MarkAsProcessed marks the provided offset as highest processed offset if
 // it's higher than any previous offset it has received.
 func (pot *partitionOffsetTracker) markAsProcessed(offset int64) bool {
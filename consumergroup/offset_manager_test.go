@@ -0,0 +1,278 @@
+package consumergroup
+
+import (
+	"context"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+type fencedConsumerGroupManager struct {
+	mockConsumerGroupManager
+	epochs []int32
+}
+
+func (cgm *fencedConsumerGroupManager) CommitOffset(topic string, partition int32, offset int64, epoch int32, version int32) error {
+	cgm.epochs = append(cgm.epochs, epoch)
+	return ErrPartitionFenced
+}
+
+func TestFencedCommitAbortsPartition(t *testing.T) {
+	group := &fencedConsumerGroupManager{}
+	cg, _ := newMockConsumerGroup("FencingConsumerGroup", []string{"Topic"}, nil, nil)
+	cg.group = group
+
+	ctx, abort := context.WithCancelCause(context.Background())
+	cg.addClaim("Topic", 0, &partitionClaim{epoch: 3, abort: abort})
+
+	if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+	cg.offsetManager.MarkAsProcessed("Topic", 0, 10)
+
+	if err := cg.offsetManager.Flush(); err != nil {
+		t.Errorf("Expected the fenced partition not to fail the flush, got %v", err)
+	}
+	if len(group.epochs) != 1 || group.epochs[0] != 3 {
+		t.Errorf("Expected the offset to be committed with epoch 3, got %v", group.epochs)
+	}
+	if context.Cause(ctx) != ErrPartitionFenced {
+		t.Errorf("Expected the partition consumer to be fenced, got %v", context.Cause(ctx))
+	}
+
+	cg.offsetManager.(partitionDiscarder).DiscardPartition("Topic", 0)
+	if err := cg.offsetManager.Close(); err != nil {
+		t.Errorf("Expected a clean close after discarding the partition, got %v", err)
+	}
+}
+
+// releaseRecordingInstanceManager records the partitions that are released.
+type releaseRecordingInstanceManager struct {
+	mockConsumerGroupInstanceManager
+	mu       sync.Mutex
+	released []int32
+}
+
+func (cgim *releaseRecordingInstanceManager) ReleasePartition(topic string, partition int32) error {
+	cgim.mu.Lock()
+	defer cgim.mu.Unlock()
+	cgim.released = append(cgim.released, partition)
+	return nil
+}
+
+func TestFencedFinalCommitIsReported(t *testing.T) {
+	for _, bounded := range []bool{false, true} {
+		config := NewConfig()
+		config.Bounded.Enabled = bounded
+		config.Bounded.EndOffsets = map[string]map[int32]int64{"Topic": {0: 2}}
+		cg, _ := newMockConsumerGroup("FencingConsumerGroup", []string{"Topic"}, nil, config)
+		cg.group = &fencedConsumerGroupManager{}
+		cg.consumer = &singleMessageConsumer{}
+		instance := &releaseRecordingInstanceManager{}
+		cg.instance = instance
+
+		assigned := newAssignment(cg, 1)
+		assigned.add("Topic", []int32{0})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go cg.partitionConsumer(ctx, "Topic", 0, assigned, cg.messages, cg.errors, &wg)
+
+		// A bounded partition commits its final offset once it reached its end, others
+		// when they are released.
+		cg.CommitUpto(<-cg.messages)
+		if !bounded {
+			cancel()
+		}
+
+		select {
+		case err := <-cg.errors:
+			if consumerErr, ok := err.(*sarama.ConsumerError); !ok || consumerErr.Err != ErrPartitionFenced {
+				t.Errorf("Expected ErrPartitionFenced, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Expected the fenced final commit to be reported (bounded: %v)", bounded)
+		}
+		cancel()
+		wg.Wait()
+
+		if len(instance.released) != 0 {
+			t.Errorf("Expected the fenced partition not to be released (bounded: %v), got %v", bounded, instance.released)
+		}
+		select {
+		case err := <-cg.errors:
+			t.Errorf("Expected no other error (bounded: %v), got %v", bounded, err)
+		default:
+		}
+	}
+}
+
+// newRegressionConsumerGroup returns a consumer group whose offsets are stored in a fake
+// Zookeeper, starting with offset 100 for Topic/0.
+func newRegressionConsumerGroup(t *testing.T, conn zookeeperConn, policy RegressionPolicy) *ConsumerGroup {
+	config := NewConfig()
+	config.Offsets.Regression = policy
+	config.MetricRegistry = metrics.NewRegistry()
+	cg, _ := newMockConsumerGroup("RegressionConsumerGroup", []string{"Topic"}, nil, config)
+	cg.group = newZookeeperGroup(conn, "", "RegressionConsumerGroup")
+	if err := cg.group.CommitOffset("Topic", 0, 100, -1, -1); err != nil {
+		t.Fatal(err)
+	}
+	return cg
+}
+
+func TestRegressionPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy      RegressionPolicy
+		stored      int64
+		regressions int64
+	}{
+		{RegressionAllow, 50, 0},
+		{RegressionWarn, 50, 1},
+		{RegressionReject, 100, 1},
+	} {
+		cg := newRegressionConsumerGroup(t, newFakeConn(), test.policy)
+
+		// Another instance moves the offset on to 100 while this one consumes from 40.
+		if err := cg.group.CommitOffset("Topic", 0, 40, -1, -1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := cg.group.CommitOffset("Topic", 0, 100, -1, -1); err != nil {
+			t.Fatal(err)
+		}
+		cg.offsetManager.MarkAsProcessed("Topic", 0, 49)
+
+		if err := cg.offsetManager.Flush(); err != nil {
+			t.Errorf("%d: Expected the flush to succeed, got %v", test.policy, err)
+		}
+		if stored, _ := cg.group.FetchOffset("Topic", 0); stored != test.stored {
+			t.Errorf("%d: Expected the stored offset to be %d, got %d", test.policy, test.stored, stored)
+		}
+		if count := metrics.GetOrRegisterCounter("consumergroup-offset-regressions", cg.config.MetricRegistry).Count(); count != test.regressions {
+			t.Errorf("%d: Expected %d regressions, got %d", test.policy, test.regressions, count)
+		}
+		_ = cg.offsetManager.Close()
+	}
+}
+
+// racingConn moves the stored offset on right before the first commit of an offset, as
+// if another instance committed between the regression check and the commit.
+type racingConn struct {
+	*fakeConn
+	raced bool
+}
+
+func (c *racingConn) Multi(ops ...interface{}) ([]zk.MultiResponse, error) {
+	if !c.raced {
+		c.raced = true
+		if _, err := c.fakeConn.Set("/consumers/RegressionConsumerGroup/offsets/Topic/0", []byte("300"), -1); err != nil {
+			return nil, err
+		}
+	}
+	return c.fakeConn.Multi(ops...)
+}
+
+func TestRegressionCheckDetectsConcurrentCommit(t *testing.T) {
+	conn := &racingConn{fakeConn: newFakeConn(), raced: true}
+	cg := newRegressionConsumerGroup(t, conn, RegressionReject)
+	conn.raced = false
+
+	if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+	cg.offsetManager.MarkAsProcessed("Topic", 0, 149)
+
+	if err := cg.offsetManager.Flush(); err != nil {
+		t.Errorf("Expected the flush to succeed, got %v", err)
+	}
+	if stored, _ := cg.group.FetchOffset("Topic", 0); stored != 300 {
+		t.Errorf("Expected the concurrent commit of offset 300 to be kept, got %d", stored)
+	}
+	_ = cg.offsetManager.Close()
+}
+
+func TestRewindOffset(t *testing.T) {
+	cg := newRegressionConsumerGroup(t, newFakeConn(), RegressionReject)
+
+	if err := cg.RewindOffset("Topic", 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := cg.group.FetchOffset("Topic", 0); stored != 10 {
+		t.Errorf("Expected the rewind to bypass the regression policy, got %d", stored)
+	}
+
+	_, abort := context.WithCancelCause(context.Background())
+	cg.addClaim("Topic", 0, &partitionClaim{epoch: 0, abort: abort})
+	if err := cg.RewindOffset("Topic", 0, 5); err != PartitionInUse {
+		t.Errorf("Expected PartitionInUse, got %v", err)
+	}
+
+	other := cg.group.(*zookeeperGroup).Instance("other-instance", instanceRegistration{})
+	if _, err := other.ClaimPartition("Topic", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := cg.RewindOffset("Topic", 1, 5); err != PartitionInUse {
+		t.Errorf("Expected PartitionInUse for a partition claimed by another instance, got %v", err)
+	}
+	if stored, _ := cg.group.FetchOffset("Topic", 1); stored != -1 {
+		t.Errorf("Expected no offset to be stored for the claimed partition, got %d", stored)
+	}
+
+	if err := cg.RewindOffset("Topic", 2, -1); err == nil {
+		t.Error("Expected a negative offset to be rejected")
+	}
+
+	cg.config.Shadow.Enabled = true
+	if err := cg.RewindOffset("Topic", 1, 5); err != ShadowReadOnly {
+		t.Errorf("Expected ShadowReadOnly, got %v", err)
+	}
+	_ = cg.offsetManager.Close()
+}
+
+// claimingConn lets another instance claim Topic/0 right after the owners of the
+// partitions were listed.
+type claimingConn struct {
+	*fakeConn
+	claimed bool
+}
+
+func (c *claimingConn) Children(node string) ([]string, *zk.Stat, error) {
+	children, stat, err := c.fakeConn.Children(node)
+	if !c.claimed && path.Base(node) == "owners" {
+		c.claimed = true
+		other := newZookeeperGroup(c.fakeConn, "", "RegressionConsumerGroup").Instance("other-instance", instanceRegistration{})
+		if _, err := other.ClaimPartition("Topic", 0); err != nil {
+			return nil, nil, err
+		}
+	}
+	return children, stat, err
+}
+
+func TestRewindOffsetFailsWhenClaimedMeanwhile(t *testing.T) {
+	cg := newRegressionConsumerGroup(t, &claimingConn{fakeConn: newFakeConn()}, RegressionReject)
+
+	if err := cg.RewindOffset("Topic", 0, 10); err != PartitionInUse {
+		t.Errorf("Expected PartitionInUse, got %v", err)
+	}
+	if stored, _ := cg.group.FetchOffset("Topic", 0); stored != 100 {
+		t.Errorf("Expected the stored offset to be kept, got %d", stored)
+	}
+	_ = cg.offsetManager.Close()
+}
+
+func TestRegressionValidation(t *testing.T) {
+	config := NewConfig()
+	config.Offsets.Regression = RegressionReject + 1
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an unknown regression policy to be rejected")
+	}
+}
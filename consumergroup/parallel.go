@@ -0,0 +1,150 @@
+package consumergroup
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// ProcessByKey processes the messages of the consumer group with a pool of workers, so
+// that a single partition can be processed by more than one goroutine. Messages with the
+// same key are always handled by the same worker, in the order of their offsets, so the
+// ordering per key is kept. Messages without a key are spread over the workers.
+//
+// Offsets are marked as processed once the handler returns, but only up to the first
+// message of a partition that is still being handled, so the committed offset never
+// passes an unprocessed message. ProcessByKey returns once the consumer group is closed
+// and all messages have been handled. Do not read Messages() or call CommitUpto while
+// using it. It cannot be used with Config.Batches or Config.Deliveries.
+func (cg *ConsumerGroup) ProcessByKey(workers int, handler func(*sarama.ConsumerMessage)) error {
+	if workers < 1 {
+		return sarama.ConfigurationError("ProcessByKey needs at least 1 worker")
+	}
+	if cg.config.Batches.Enabled || cg.config.Deliveries.Enabled {
+		return sarama.ConfigurationError("ProcessByKey cannot be used with Batches or Deliveries")
+	}
+
+	completions := newCompletionTracker(cg)
+
+	var wg sync.WaitGroup
+	queues := make([]chan trackedMessage, workers)
+	for i := range queues {
+		queues[i] = make(chan trackedMessage, cg.config.ChannelBufferSize)
+		wg.Add(1)
+		go func(queue <-chan trackedMessage) {
+			defer wg.Done()
+			for tracked := range queue {
+				handler(tracked.message)
+				completions.complete(tracked.message, tracked.claim)
+			}
+		}(queues[i])
+	}
+
+	next := 0
+	for message := range cg.messages {
+		claim, ok := completions.deliver(message)
+		if !ok {
+			continue
+		}
+
+		var worker int
+		if message.Key == nil {
+			worker = next
+			next = (next + 1) % workers
+		} else {
+			hash := fnv.New32a()
+			hash.Write(message.Key)
+			worker = int(hash.Sum32() % uint32(workers))
+		}
+		queues[worker] <- trackedMessage{message: message, claim: claim}
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	return nil
+}
+
+// trackedMessage is a message that is being processed during a claim of its partition.
+type trackedMessage struct {
+	message *sarama.ConsumerMessage
+	claim   *pendingOffsets
+}
+
+// completionTracker keeps track of the messages of every partition that are being
+// processed, and marks offsets as processed only when all earlier messages that were
+// delivered from the same partition have been processed as well.
+type completionTracker struct {
+	cg         *ConsumerGroup
+	l          sync.Mutex
+	partitions map[string]map[int32]*pendingOffsets
+}
+
+// pendingOffsets holds the delivered offsets of a partition that have not been marked as
+// processed yet, in the order they were delivered. A new one is started for every claim
+// of the partition, so that messages of an earlier claim that complete late are ignored.
+type pendingOffsets struct {
+	claim     *partitionClaim
+	last      int64 // The highest offset delivered during the claim.
+	offsets   []int64
+	completed map[int64]bool
+}
+
+func newCompletionTracker(cg *ConsumerGroup) *completionTracker {
+	return &completionTracker{cg: cg, partitions: make(map[string]map[int32]*pendingOffsets)}
+}
+
+// deliver records that a message is about to be processed, and returns the claim it
+// must be completed with. It returns false if the message was already delivered during
+// the current claim of its partition, e.g. because consumption of the partition was
+// re-established, in which case it must not be processed again.
+func (ct *completionTracker) deliver(message *sarama.ConsumerMessage) (*pendingOffsets, bool) {
+	claim := ct.cg.currentClaim(message.Topic, message.Partition)
+
+	ct.l.Lock()
+	defer ct.l.Unlock()
+
+	if ct.partitions[message.Topic] == nil {
+		ct.partitions[message.Topic] = make(map[int32]*pendingOffsets)
+	}
+	pending := ct.partitions[message.Topic][message.Partition]
+
+	// After a rebalance, whatever was pending belongs to the previous claim.
+	if pending == nil || pending.claim != claim {
+		pending = &pendingOffsets{claim: claim, last: -1, completed: make(map[int64]bool)}
+		ct.partitions[message.Topic][message.Partition] = pending
+	}
+	if message.Offset <= pending.last {
+		return pending, false
+	}
+	pending.last = message.Offset
+	pending.offsets = append(pending.offsets, message.Offset)
+	return pending, true
+}
+
+// complete records that a message that was delivered during a claim has been processed,
+// and marks the offsets up to the first message that is still being processed as
+// processed. It does nothing if the partition was claimed again in the meantime.
+func (ct *completionTracker) complete(message *sarama.ConsumerMessage, claim *pendingOffsets) {
+	ct.l.Lock()
+	pending := ct.partitions[message.Topic][message.Partition]
+	if pending == nil || pending != claim {
+		ct.l.Unlock()
+		return
+	}
+	pending.completed[message.Offset] = true
+
+	processed := int64(-1)
+	for len(pending.offsets) > 0 && pending.completed[pending.offsets[0]] {
+		processed = pending.offsets[0]
+		delete(pending.completed, processed)
+		pending.offsets = pending.offsets[1:]
+	}
+	ct.l.Unlock()
+
+	if processed >= 0 {
+		ct.cg.offsetManager.MarkAsProcessed(message.Topic, message.Partition, processed)
+	}
+}
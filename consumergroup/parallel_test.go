@@ -0,0 +1,150 @@
+package consumergroup
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestCompletionTrackerMarksContiguousOffsets(t *testing.T) {
+	cg, _ := newMockConsumerGroup("ParallelConsumerGroup", []string{"Topic"}, nil, nil)
+	if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+	tracker := cg.offsetManager.(*zookeeperOffsetManager).offsets["Topic"][0]
+	initial := tracker.highestProcessedOffset
+
+	ct := newCompletionTracker(cg)
+	messages := make([]*sarama.ConsumerMessage, 3)
+	claims := make([]*pendingOffsets, 3)
+	for i := range messages {
+		messages[i] = &sarama.ConsumerMessage{Topic: "Topic", Partition: 0, Offset: int64(10 + 2*i)}
+		claims[i], _ = ct.deliver(messages[i])
+	}
+
+	ct.complete(messages[1], claims[1])
+	if tracker.highestProcessedOffset != initial {
+		t.Errorf("Expected no offset to be processed while offset 10 is pending, got %d", tracker.highestProcessedOffset)
+	}
+	ct.complete(messages[0], claims[0])
+	if tracker.highestProcessedOffset != 12 {
+		t.Errorf("Expected offset 12 to be processed, got %d", tracker.highestProcessedOffset)
+	}
+	ct.complete(messages[2], claims[2])
+	if tracker.highestProcessedOffset != 14 {
+		t.Errorf("Expected offset 14 to be processed, got %d", tracker.highestProcessedOffset)
+	}
+}
+
+func TestCompletionTrackerIgnoresEarlierClaims(t *testing.T) {
+	cg, _ := newMockConsumerGroup("ParallelConsumerGroup", []string{"Topic"}, nil, nil)
+	if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+	tracker := cg.offsetManager.(*zookeeperOffsetManager).offsets["Topic"][0]
+	initial := tracker.highestProcessedOffset
+
+	ct := newCompletionTracker(cg)
+	cg.addClaim("Topic", 0, &partitionClaim{epoch: 1})
+	stale := &sarama.ConsumerMessage{Topic: "Topic", Partition: 0, Offset: 11}
+	staleClaim, _ := ct.deliver(stale)
+
+	// The partition is claimed again and the message is delivered again.
+	cg.addClaim("Topic", 0, &partitionClaim{epoch: 2})
+	redelivered := &sarama.ConsumerMessage{Topic: "Topic", Partition: 0, Offset: 11}
+	claim, ok := ct.deliver(redelivered)
+	if !ok {
+		t.Fatal("Expected the message to be delivered again during a new claim")
+	}
+
+	ct.complete(stale, staleClaim)
+	if tracker.highestProcessedOffset != initial {
+		t.Errorf("Expected a completion of an earlier claim to be ignored, got offset %d", tracker.highestProcessedOffset)
+	}
+	if !ct.pending(redelivered, claim) || ct.pending(stale, staleClaim) {
+		t.Error("Expected only the redelivered message to be pending")
+	}
+	ct.complete(redelivered, claim)
+	if tracker.highestProcessedOffset != 11 {
+		t.Errorf("Expected offset 11 to be processed, got %d", tracker.highestProcessedOffset)
+	}
+}
+
+func TestCompletionTrackerSkipsDuplicatesOfTheSameClaim(t *testing.T) {
+	cg, _ := newMockConsumerGroup("ParallelConsumerGroup", []string{"Topic"}, nil, nil)
+	if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+	tracker := cg.offsetManager.(*zookeeperOffsetManager).offsets["Topic"][0]
+	initial := tracker.highestProcessedOffset
+
+	ct := newCompletionTracker(cg)
+	cg.addClaim("Topic", 0, &partitionClaim{})
+	first := &sarama.ConsumerMessage{Topic: "Topic", Partition: 0, Offset: 10}
+	second := &sarama.ConsumerMessage{Topic: "Topic", Partition: 0, Offset: 11}
+	claim, _ := ct.deliver(first)
+	ct.deliver(second)
+
+	// Consumption of the partition is re-established, and delivers the messages again.
+	if _, ok := ct.deliver(&sarama.ConsumerMessage{Topic: "Topic", Partition: 0, Offset: 10}); ok {
+		t.Error("Expected a message that was delivered during the same claim to be skipped")
+	}
+
+	ct.complete(second, claim)
+	if tracker.highestProcessedOffset != initial || !ct.pending(first, claim) {
+		t.Errorf("Expected offset 10 to stay pending, got offset %d", tracker.highestProcessedOffset)
+	}
+	ct.complete(first, claim)
+	if tracker.highestProcessedOffset != 11 {
+		t.Errorf("Expected offset 11 to be processed, got %d", tracker.highestProcessedOffset)
+	}
+}
+
+func TestProcessByKeyRejectsBatchesAndDeliveries(t *testing.T) {
+	for _, enable := range []func(*Config){
+		func(config *Config) { config.Batches.Enabled = true },
+		func(config *Config) { config.Deliveries.Enabled = true },
+	} {
+		config := NewConfig()
+		enable(config)
+		cg, _ := newMockConsumerGroup("ParallelConsumerGroup", []string{"Topic"}, nil, config)
+		if _, ok := cg.ProcessByKey(1, func(*sarama.ConsumerMessage) {}).(sarama.ConfigurationError); !ok {
+			t.Error("Expected ProcessByKey to be rejected")
+		}
+	}
+}
+
+func TestProcessByKeyKeepsOrderPerKey(t *testing.T) {
+	cg, _ := newMockConsumerGroup("ParallelConsumerGroup", []string{"Topic"}, nil, nil)
+	if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"a", "b", "c", "d"}
+	go func() {
+		for offset := int64(0); offset < 100; offset++ {
+			key := keys[offset%int64(len(keys))]
+			cg.messages <- &sarama.ConsumerMessage{Topic: "Topic", Partition: 0, Offset: offset, Key: []byte(key)}
+		}
+		close(cg.messages)
+	}()
+
+	var l sync.Mutex
+	seen := make(map[string]int64)
+	err := cg.ProcessByKey(3, func(message *sarama.ConsumerMessage) {
+		l.Lock()
+		defer l.Unlock()
+		if last, ok := seen[string(message.Key)]; ok && last > message.Offset {
+			t.Errorf("Offset %d of key %s was processed after offset %d", message.Offset, message.Key, last)
+		}
+		seen[string(message.Key)] = message.Offset
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if processed := cg.offsetManager.(*zookeeperOffsetManager).offsets["Topic"][0].highestProcessedOffset; processed != 99 {
+		t.Errorf("Expected all offsets to be processed, got %d", processed)
+	}
+}
@@ -0,0 +1,140 @@
+package consumergroup
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+)
+
+// checkPoison counts an attempt to consume a partition from offset, and skips the message
+// at offset if consuming from there failed too often. It returns the offset to consume
+// from. The attempts are counted in Zookeeper, so that they survive crashes of the
+// application, and forgotten when the partition is released cleanly, so that rebalances
+// and deployments do not count.
+//
+// An attempt that did not end cleanly may have failed on any message after offset, up to
+// the last one it received. The next attempt commits every processed message up to there,
+// so that the attempts after it count against the message that fails, and only that
+// message is skipped.
+func (cg *ConsumerGroup) checkPoison(topic string, partition int32, offset int64) int64 {
+	// There is nothing to fail on at the end of the partition.
+	if cg.client != nil {
+		if newest, err := cg.client.GetOffset(topic, partition, sarama.OffsetNewest); err == nil && offset >= newest {
+			return offset
+		}
+	}
+
+	attempts, located, reached, err := cg.group.RecordAttempt(topic, partition, offset)
+	if err != nil {
+		cg.Logf("%s/%d :: FAILED to record the attempt to consume from offset %d: %s\n", topic, partition, offset, err)
+		return offset
+	}
+	if attempts > 1 {
+		if tracker, ok := cg.offsetManager.(attemptTracker); ok {
+			if reached < offset {
+				// The earlier attempt failed before it stored how far it got.
+				reached = -1
+				cg.Logf("%s/%d :: Consuming from offset %d did not end cleanly before, committing every processed message.\n", topic, partition, offset)
+			} else {
+				cg.Logf("%s/%d :: Consuming from offset %d did not end cleanly before, committing every processed message up to offset %d.\n", topic, partition, offset, reached)
+			}
+			tracker.TrackAttempts(topic, partition, reached)
+		}
+	}
+	if attempts <= cg.config.Poison.MaxAttempts || !located {
+		return offset
+	}
+
+	if deadLetterTopic := cg.config.Poison.DeadLetterTopic; deadLetterTopic != "" {
+		if err := cg.deadLetter(topic, partition, offset); err != nil {
+			cg.Logf("%s/%d :: FAILED to produce poison message %d to %s, not skipping it: %s\n", topic, partition, offset, deadLetterTopic, err)
+			return offset
+		}
+	}
+
+	cg.Logf("%s/%d :: SKIPPING poison message %d after %d attempts to consume it!\n", topic, partition, offset, attempts-1)
+	metrics.GetOrRegisterCounter("consumergroup-poison-messages", cg.config.MetricRegistry).Inc(1)
+	cg.notify(&PoisonMessage{Topic: topic, Partition: partition, Offset: offset, Attempts: attempts - 1, DeadLetterTopic: cg.config.Poison.DeadLetterTopic})
+
+	cg.offsetManager.MarkAsProcessed(topic, partition, offset)
+	return offset + 1
+}
+
+// clearAttempts forgets the attempts to consume a partition once all its messages were
+// processed and committed, so that only attempts that did not end cleanly are counted.
+func (cg *ConsumerGroup) clearAttempts(topic string, partition int32) {
+	if cg.config.Poison.MaxAttempts == 0 {
+		return
+	}
+	if err := cg.group.ClearAttempts(topic, partition); err != nil {
+		cg.Logf("%s/%d :: FAILED to clear the attempts to consume the partition: %s\n", topic, partition, err)
+	}
+}
+
+// deadLetter produces the message at offset to the dead letter topic.
+func (cg *ConsumerGroup) deadLetter(topic string, partition int32, offset int64) error {
+	if cg.client == nil {
+		return fmt.Errorf("no Kafka client")
+	}
+
+	message, err := cg.fetchMessage(topic, partition, offset)
+	if err != nil {
+		return err
+	}
+
+	producer, err := cg.deadLetterProducer()
+	if err != nil {
+		return err
+	}
+
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers))
+	for _, header := range message.Headers {
+		headers = append(headers, *header)
+	}
+	_, _, err = producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   cg.config.Poison.DeadLetterTopic,
+		Key:     sarama.ByteEncoder(message.Key),
+		Value:   sarama.ByteEncoder(message.Value),
+		Headers: headers,
+	})
+	return err
+}
+
+// fetchMessage reads the message at offset of a partition that is not being consumed.
+func (cg *ConsumerGroup) fetchMessage(topic string, partition int32, offset int64) (*sarama.ConsumerMessage, error) {
+	consumer, err := cg.consumerFor(topic).ConsumePartition(topic, partition, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	select {
+	case message := <-consumer.Messages():
+		if message.Offset != offset {
+			return nil, fmt.Errorf("message %d is not available anymore", offset)
+		}
+		return message, nil
+	case err := <-consumer.Errors():
+		return nil, err
+	case <-time.After(cg.config.processingTimeout(topic)):
+		return nil, fmt.Errorf("TIMEOUT fetching message %d", offset)
+	}
+}
+
+// deadLetterProducer returns the producer for the dead letter topic, creating it the
+// first time it is needed.
+func (cg *ConsumerGroup) deadLetterProducer() (sarama.SyncProducer, error) {
+	cg.deadLettersMu.Lock()
+	defer cg.deadLettersMu.Unlock()
+
+	if cg.deadLetters == nil {
+		producer, err := sarama.NewSyncProducerFromClient(cg.client)
+		if err != nil {
+			return nil, err
+		}
+		cg.deadLetters = producer
+	}
+	return cg.deadLetters, nil
+}
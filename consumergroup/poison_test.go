@@ -0,0 +1,266 @@
+package consumergroup
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type attemptingConsumerGroupManager struct {
+	mockConsumerGroupManager
+	offset   int64
+	attempts int
+}
+
+func (cgm *attemptingConsumerGroupManager) RecordAttempt(topic string, partition int32, offset int64) (int, bool, int64, error) {
+	if offset != cgm.offset {
+		cgm.offset, cgm.attempts = offset, 0
+	}
+	cgm.attempts++
+	// Every attempt after the second one follows an attempt that moved the offset forward.
+	return cgm.attempts, cgm.attempts > 2, -1, nil
+}
+
+func (cgm *attemptingConsumerGroupManager) ClearAttempts(topic string, partition int32) error {
+	cgm.offset, cgm.attempts = -1, 0
+	return nil
+}
+
+func TestPoisonMessageIsSkipped(t *testing.T) {
+	config := NewConfig()
+	config.Notifications.Enabled = true
+	config.Poison.MaxAttempts = 2
+
+	cg, _ := newMockConsumerGroup("PoisonConsumerGroup", []string{"Topic"}, nil, config)
+	cg.group = &attemptingConsumerGroupManager{offset: -1}
+
+	initial, err := cg.offsetManager.InitializePartition("Topic", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if offset := cg.checkPoison("Topic", 0, initial); offset != initial {
+			t.Fatalf("Expected attempt %d to start at %d, got %d", attempt, initial, offset)
+		}
+	}
+	if offset := cg.checkPoison("Topic", 0, initial); offset != initial+1 {
+		t.Fatalf("Expected the poison message to be skipped, got offset %d", offset)
+	}
+
+	poison, ok := (<-cg.Notifications()).(*PoisonMessage)
+	if !ok || poison.Offset != initial || poison.Attempts != 2 {
+		t.Errorf("Expected the poison message to be reported, got %#v", poison)
+	}
+	if highest := cg.offsetManager.(*zookeeperOffsetManager).offsets["Topic"][0].highestProcessedOffset; highest != initial {
+		t.Errorf("Expected the poison message to be marked as processed, got %d", highest)
+	}
+
+	if offset := cg.checkPoison("Topic", 0, initial+1); offset != initial+1 {
+		t.Errorf("Expected the next message to get its own attempts, got offset %d", offset)
+	}
+}
+
+func TestCleanReleaseClearsAttempts(t *testing.T) {
+	config := NewConfig()
+	config.Poison.MaxAttempts = 2
+
+	cg, _ := newMockConsumerGroup("PoisonConsumerGroup", []string{"Topic"}, nil, config)
+	cg.consumer = &idleConsumer{}
+	group := &attemptingConsumerGroupManager{offset: -1}
+	cg.group = group
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go cg.partitionConsumer(ctx, "Topic", 0, newAssignment(cg, 1), cg.messages, cg.errors, &wg)
+	cancel()
+	wg.Wait()
+
+	if group.attempts != 0 {
+		t.Errorf("Expected a clean release to clear the attempts, got %d", group.attempts)
+	}
+}
+
+func TestZookeeperGroupAttempts(t *testing.T) {
+	group := newZookeeperGroup(newFakeConn(), "", "PoisonGroup")
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		attempts, located, reached, err := group.RecordAttempt("Topic", 0, 10)
+		if err != nil || attempts != attempt || located != (attempt == 3) || reached != -1 {
+			t.Fatalf("Expected attempt %d, got %d (located: %v, reached: %d), %v", attempt, attempts, located, reached, err)
+		}
+	}
+	if err := group.AdvanceAttempts("Topic", 0, 12, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.RecordReached("Topic", 0, 20); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, located, reached, err := group.RecordAttempt("Topic", 0, 12); err != nil || attempts != 2 || !located || reached != 20 {
+		t.Errorf("Expected the second located attempt from offset 12 after reaching offset 20, got %d (located: %v, reached: %d), %v", attempts, located, reached, err)
+	}
+	if err := group.AdvanceAttempts("Topic", 0, 21, false); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, located, _, err := group.RecordAttempt("Topic", 0, 21); err != nil || attempts != 2 || located {
+		t.Errorf("Expected the second attempt from offset 21 not to be located, got %d (located: %v), %v", attempts, located, err)
+	}
+	if err := group.ClearAttempts("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.ClearAttempts("Topic", 0); err != nil {
+		t.Errorf("Expected clearing twice to succeed, got %v", err)
+	}
+	if err := group.RecordReached("Topic", 0, 20); err != nil {
+		t.Errorf("Expected recording without attempts to be ignored, got %v", err)
+	}
+	if attempts, _, _, err := group.RecordAttempt("Topic", 0, 10); err != nil || attempts != 1 {
+		t.Errorf("Expected the attempts to be counted from 1 again, got %d, %v", attempts, err)
+	}
+}
+
+func TestPoisonMessageIsLocated(t *testing.T) {
+	config := NewConfig()
+	config.Poison.MaxAttempts = 1
+
+	cg, _ := newMockConsumerGroup("PoisonConsumerGroup", []string{"Topic"}, nil, config)
+	group := newZookeeperGroup(newFakeConn(), "", "PoisonConsumerGroup")
+	if err := group.CommitOffset("Topic", 0, 10, -1, -1); err != nil {
+		t.Fatal(err)
+	}
+	cg.group = group
+
+	// attempt starts consuming the partition, processes the messages before offset 12,
+	// and crashes on the message at offset 12 before the offsets are committed.
+	attempt := func() int64 {
+		t.Helper()
+		offset, err := cg.offsetManager.InitializePartition("Topic", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := cg.checkPoison("Topic", 0, offset)
+		for processed := start; processed < 12; processed++ {
+			cg.offsetManager.MarkAsProcessed("Topic", 0, processed)
+		}
+		// The offset committer catches up before the crash.
+		cg.offsetManager.(*zookeeperOffsetManager).commitTrackedOffsets()
+		cg.offsetManager.(partitionDiscarder).DiscardPartition("Topic", 0)
+		return start
+	}
+
+	if start := attempt(); start != 10 {
+		t.Fatalf("Expected the first attempt to start at offset 10, got %d", start)
+	}
+	if start := attempt(); start != 10 {
+		t.Fatalf("Expected offset 10 not to be skipped, got %d", start)
+	}
+	if start := attempt(); start != 13 {
+		t.Fatalf("Expected only the message at offset 12 to be skipped, got %d", start)
+	}
+}
+
+// startRecordingConsumer sends the offsets partitions are consumed from.
+type startRecordingConsumer struct {
+	idleConsumer
+	starts chan int64
+}
+
+func (c *startRecordingConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	c.starts <- offset
+	return c.idleConsumer.ConsumePartition(topic, partition, offset)
+}
+
+func TestPoisonMessageWithoutCommittedOffsetIsSkipped(t *testing.T) {
+	config := NewConfig()
+	config.Poison.MaxAttempts = 1
+
+	cg, _ := newMockConsumerGroup("PoisonConsumerGroup", []string{"Topic"}, nil, config)
+	cg.group = newZookeeperGroup(newFakeConn(), "", "PoisonConsumerGroup")
+	cg.client = &offsetClient{oldest: 5, newest: 20}
+	consumer := &startRecordingConsumer{starts: make(chan int64, 1)}
+	cg.consumer = consumer
+
+	// Every attempt crashes on the oldest message before committing an offset, which
+	// abandons the partition like an expired session does.
+	for attempt, expected := range []int64{5, 5, 6} {
+		ctx, crash := context.WithCancelCause(context.Background())
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go cg.partitionConsumer(ctx, "Topic", 0, newAssignment(cg, 1), cg.messages, cg.errors, &wg)
+
+		select {
+		case start := <-consumer.starts:
+			if start != expected {
+				t.Errorf("Expected attempt %d to start at offset %d, got %d", attempt+1, expected, start)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected attempt %d to start consuming", attempt+1)
+		}
+		crash(SessionExpired)
+		wg.Wait()
+	}
+	_ = cg.offsetManager.Close()
+}
+
+func TestPoisonTrackingStopsAtReachedOffset(t *testing.T) {
+	config := NewConfig()
+	config.Poison.MaxAttempts = 1
+
+	cg, _ := newMockConsumerGroup("PoisonConsumerGroup", []string{"Topic"}, nil, config)
+	group := newZookeeperGroup(newFakeConn(), "", "PoisonConsumerGroup")
+	if err := group.CommitOffset("Topic", 0, 10, -1, -1); err != nil {
+		t.Fatal(err)
+	}
+	cg.group = group
+	zom := cg.offsetManager.(*zookeeperOffsetManager)
+
+	start := func() int64 {
+		t.Helper()
+		offset, err := zom.InitializePartition("Topic", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cg.checkPoison("Topic", 0, offset)
+	}
+
+	// The first attempt receives the messages up to offset 14, and is killed before it
+	// processed any of them.
+	if offset := start(); offset != 10 {
+		t.Fatalf("Expected the first attempt to start at offset 10, got %d", offset)
+	}
+	for received := int64(10); received <= 14; received++ {
+		zom.MarkAsReceived("Topic", 0, received)
+	}
+	if err := zom.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	zom.DiscardPartition("Topic", 0)
+
+	// The second attempt commits every processed message until it processed offset 14.
+	if offset := start(); offset != 10 {
+		t.Fatalf("Expected the second attempt to start at offset 10, got %d", offset)
+	}
+	tracker := zom.offsets["Topic"][0]
+	for processed := int64(10); processed <= 14; processed++ {
+		if !tracker.tracksAttempts() {
+			t.Fatalf("Expected every message up to offset 14 to be committed right away, stopped at %d", processed)
+		}
+		zom.MarkAsProcessed("Topic", 0, processed)
+		zom.commitTrackedOffsets()
+	}
+	if tracker.tracksAttempts() {
+		t.Error("Expected offsets to be committed periodically after offset 14")
+	}
+	zom.DiscardPartition("Topic", 0)
+
+	// An attempt that did not end cleanly after tracking stopped does not locate a message.
+	if offset := start(); offset != 15 {
+		t.Errorf("Expected the third attempt to start at offset 15 without skipping, got %d", offset)
+	}
+	zom.DiscardPartition("Topic", 0)
+	_ = zom.Close()
+}
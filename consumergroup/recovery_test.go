@@ -0,0 +1,86 @@
+package consumergroup
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+type failingConsumerGroupManager struct {
+	mockConsumerGroupManager
+}
+
+func (cgm *failingConsumerGroupManager) WatchInstances() ([]*Member, <-chan zk.Event, error) {
+	return nil, nil, zk.ErrConnectionClosed
+}
+
+func TestWatchFailuresReportFatalError(t *testing.T) {
+	config := NewConfig()
+	config.Recovery.Backoff = time.Millisecond
+	config.Recovery.MaxBackoff = 2 * time.Millisecond
+	config.Recovery.MaxFailures = 3
+
+	consumer, err := JoinConsumerGroup(
+		"RecoveryConsumerGroup",
+		[]string{"Topic"},
+		[]string{"localhost:2181"},
+		config,
+		func(name string, topics []string, zookeeper []string, config *Config) (*ConsumerGroup, error) {
+			cg, err := newMockConsumerGroup(name, topics, zookeeper, config)
+			if err == nil {
+				cg.group = &failingConsumerGroupManager{}
+			}
+			return cg, err
+		})
+	if err != nil {
+		t.Fatal("Could not start consumer")
+	}
+	defer consumer.Close()
+
+	select {
+	case <-consumer.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the consumer group to give up")
+	}
+
+	var fatal *FatalError
+	if !errors.As(consumer.Err(), &fatal) {
+		t.Fatalf("Expected a FatalError, got %v", consumer.Err())
+	}
+	if fatal.Failures != 3 || !errors.Is(fatal, zk.ErrConnectionClosed) {
+		t.Errorf("Unexpected fatal error: %v", fatal)
+	}
+
+	select {
+	case err := <-consumer.Errors():
+		if err != consumer.Err() {
+			t.Errorf("Expected the fatal error on the errors channel, got %v", err)
+		}
+	default:
+		t.Error("Expected the fatal error on the errors channel")
+	}
+}
+
+func TestRecoveryBackoffDefaults(t *testing.T) {
+	config := NewConfig()
+	config.Recovery.Backoff = 0
+	config.Recovery.MaxBackoff = 0
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected unset backoffs to use the defaults, got %s", err)
+	}
+
+	cg := &ConsumerGroup{config: config}
+	if backoff := cg.backoff(1); backoff != time.Second {
+		t.Errorf("Expected the default backoff of 1s, got %s", backoff)
+	}
+	if backoff := cg.backoff(10); backoff != 30*time.Second {
+		t.Errorf("Expected the default maximum backoff of 30s, got %s", backoff)
+	}
+
+	config.Recovery.Backoff = -time.Second
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a negative backoff to be rejected")
+	}
+}
@@ -0,0 +1,128 @@
+package consumergroup
+
+import (
+	"math"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+)
+
+// retentionSample is the newest offset of a partition at the time of a check.
+type retentionSample struct {
+	newest int64
+	at     time.Time
+}
+
+// watchRetention periodically checks whether the committed offsets of the claimed
+// partitions are about to be removed by retention.
+func (cg *ConsumerGroup) watchRetention() {
+	defer cg.background.Done()
+
+	ticker := time.NewTicker(cg.config.Retention.CheckInterval)
+	defer ticker.Stop()
+
+	samples := make(map[string]map[int32]retentionSample)
+	for {
+		select {
+		case <-cg.stopper:
+			return
+		case now := <-ticker.C:
+			samples = cg.checkRetention(samples, now)
+		}
+	}
+}
+
+// checkRetention checks the claimed partitions, and returns the newest offsets it found
+// for the next check to compute the produce rate with.
+func (cg *ConsumerGroup) checkRetention(previous map[string]map[int32]retentionSample, now time.Time) map[string]map[int32]retentionSample {
+	samples := make(map[string]map[int32]retentionSample)
+	atRisk := 0
+
+	for topic, partitions := range cg.claimedPartitions() {
+		for _, partition := range partitions {
+			committed, err := cg.group.FetchOffset(topic, partition)
+			if err != nil || committed < 0 {
+				continue
+			}
+
+			oldest, err := cg.client.GetOffset(topic, partition, sarama.OffsetOldest)
+			if err != nil {
+				cg.Logf("%s/%d :: FAILED to get the oldest offset: %s\n", topic, partition, err)
+				continue
+			}
+			newest, err := cg.client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				cg.Logf("%s/%d :: FAILED to get the newest offset: %s\n", topic, partition, err)
+				continue
+			}
+
+			sample := retentionSample{newest: newest, at: now}
+			if samples[topic] == nil {
+				samples[topic] = make(map[int32]retentionSample)
+			}
+			samples[topic][partition] = sample
+
+			var rate float64
+			if prev, ok := previous[topic][partition]; ok {
+				rate = produceRate(prev, sample)
+			} else if committed >= oldest {
+				// The produce rate is only known from the second check on.
+				continue
+			}
+
+			remaining := retentionRemaining(committed, oldest, rate)
+			if remaining >= cg.config.Retention.Margin {
+				continue
+			}
+
+			atRisk++
+			cg.Logf("%s/%d :: Committed offset %d is expected to be removed by retention in %s (oldest offset %d)!\n", topic, partition, committed, remaining, oldest)
+			metrics.GetOrRegisterCounter("consumergroup-retention-warnings", cg.config.MetricRegistry).Inc(1)
+			cg.notify(&RetentionRisk{Topic: topic, Partition: partition, Committed: committed, Oldest: oldest, Remaining: remaining})
+		}
+	}
+
+	metrics.GetOrRegisterGauge("consumergroup-retention-partitions-at-risk", cg.config.MetricRegistry).Update(int64(atRisk))
+	return samples
+}
+
+// claimedPartitions returns the partitions this instance currently consumes, by topic.
+func (cg *ConsumerGroup) claimedPartitions() map[string][]int32 {
+	cg.claimsMu.Lock()
+	defer cg.claimsMu.Unlock()
+
+	result := make(map[string][]int32)
+	for topic, claims := range cg.claims {
+		for partition := range claims {
+			result[topic] = append(result[topic], partition)
+		}
+	}
+	return result
+}
+
+// produceRate returns the number of messages produced per second between two samples.
+func produceRate(prev, next retentionSample) float64 {
+	elapsed := next.at.Sub(prev.at).Seconds()
+	if elapsed <= 0 || next.newest <= prev.newest {
+		return 0
+	}
+	return float64(next.newest-prev.newest) / elapsed
+}
+
+// retentionRemaining estimates the time until the committed offset is removed by
+// retention, assuming the oldest offset advances at the rate messages are produced.
+func retentionRemaining(committed, oldest int64, rate float64) time.Duration {
+	if committed < oldest {
+		return 0
+	}
+	if rate <= 0 {
+		return math.MaxInt64
+	}
+
+	seconds := float64(committed-oldest) / rate
+	if seconds >= math.MaxInt64/float64(time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
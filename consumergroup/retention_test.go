@@ -0,0 +1,99 @@
+package consumergroup
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestRetentionRemaining(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	rate := produceRate(retentionSample{newest: 1000, at: start}, retentionSample{newest: 1600, at: start.Add(time.Minute)})
+	if rate != 10 {
+		t.Fatalf("Expected 10 messages per second, got %v", rate)
+	}
+
+	if remaining := retentionRemaining(1300, 100, rate); remaining != 2*time.Minute {
+		t.Errorf("Expected 2 minutes until the committed offset is removed, got %s", remaining)
+	}
+	if remaining := retentionRemaining(50, 100, rate); remaining != 0 {
+		t.Errorf("Expected an offset that was already removed to have no time left, got %s", remaining)
+	}
+	if remaining := retentionRemaining(1300, 100, 0); remaining != math.MaxInt64 {
+		t.Errorf("Expected no risk without produced messages, got %s", remaining)
+	}
+}
+
+// offsetClient returns the oldest and newest offsets of every partition.
+type offsetClient struct {
+	sarama.Client
+	oldest, newest int64
+}
+
+func (c *offsetClient) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	if time == sarama.OffsetOldest {
+		return c.oldest, nil
+	}
+	return c.newest, nil
+}
+
+// committedConsumerGroupManager returns the committed offset of every partition.
+type committedConsumerGroupManager struct {
+	mockConsumerGroupManager
+	offsets map[int32]int64
+}
+
+func (cgm *committedConsumerGroupManager) FetchOffset(topic string, partition int32) (int64, error) {
+	return cgm.offsets[partition], nil
+}
+
+func TestCheckRetention(t *testing.T) {
+	config := NewConfig()
+	config.Notifications.Enabled = true
+	config.MetricRegistry = metrics.NewRegistry()
+	config.Retention.Margin = 5 * time.Minute
+
+	cg, _ := newMockConsumerGroup("RetentionConsumerGroup", []string{"Topic"}, nil, config)
+	client := &offsetClient{oldest: 100, newest: 1000}
+	cg.client = client
+	// Partition 0 is safe at first, partition 1 was already removed, and partition 2 has
+	// no committed offset.
+	cg.group = &committedConsumerGroupManager{offsets: map[int32]int64{0: 1300, 1: 50, 2: -1}}
+	for partition := int32(0); partition < 3; partition++ {
+		cg.addClaim("Topic", partition, &partitionClaim{})
+	}
+
+	// expectRisks expects a RetentionRisk with the remaining time of every partition.
+	expectRisks := func(remaining map[int32]time.Duration) {
+		t.Helper()
+		for range remaining {
+			risk := (<-cg.Notifications()).(*RetentionRisk)
+			if expected, ok := remaining[risk.Partition]; !ok || risk.Remaining != expected {
+				t.Errorf("Unexpected retention risk: %+v", risk)
+			}
+		}
+		select {
+		case n := <-cg.Notifications():
+			t.Errorf("Unexpected notification: %#v", n)
+		default:
+		}
+		if atRisk := metrics.GetOrRegisterGauge("consumergroup-retention-partitions-at-risk", config.MetricRegistry).Value(); atRisk != int64(len(remaining)) {
+			t.Errorf("Expected %d partitions at risk, got %d", len(remaining), atRisk)
+		}
+	}
+
+	start := time.Unix(1500000000, 0)
+	samples := cg.checkRetention(nil, start)
+	expectRisks(map[int32]time.Duration{1: 0})
+
+	client.newest = 1600
+	cg.checkRetention(samples, start.Add(time.Minute))
+	expectRisks(map[int32]time.Duration{0: 2 * time.Minute, 1: 0})
+
+	if warnings := metrics.GetOrRegisterCounter("consumergroup-retention-warnings", config.MetricRegistry).Count(); warnings != 3 {
+		t.Errorf("Expected 3 retention warnings, got %d", warnings)
+	}
+}
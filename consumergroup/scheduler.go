@@ -0,0 +1,231 @@
+package consumergroup
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+)
+
+// scheduler queues the messages of every partition, and delivers them to the messages
+// channel in turn: partitions of topics with a higher priority first, and partitions of
+// the same priority in weighted round-robin order. The priority and weight of every topic
+// are set in Config.Topics. The messages channel is unbuffered, so that a message of a
+// higher priority never waits behind queued ones. It cannot be used with batches.
+type scheduler struct {
+	cg    *ConsumerGroup
+	ready chan struct{} // Receives when a message was queued.
+
+	l       sync.Mutex
+	sources []*source
+	next    int
+}
+
+// source is the queue of a partition.
+type source struct {
+	topic     string
+	partition int32
+	priority  int
+	weight    int
+	credit    int
+
+	queue     chan *sarama.ConsumerMessage
+	removed   chan struct{}
+	sending   chan struct{} // Closed when the message taken from the queue was delivered or dropped.
+	delivered int64
+}
+
+// messagesBufferSize returns the size of the messages channel. The scheduler keeps the
+// messages in its own queues, so that it can still reorder them.
+func messagesBufferSize(config *Config) int {
+	if config.Scheduler.Enabled {
+		return 0
+	}
+	return config.ChannelBufferSize
+}
+
+func newScheduler(cg *ConsumerGroup) *scheduler {
+	if !cg.config.Scheduler.Enabled {
+		return nil
+	}
+	return &scheduler{cg: cg, ready: make(chan struct{}, 1)}
+}
+
+// run delivers the queued messages until the consumer group is closed.
+func (s *scheduler) run() {
+	defer s.cg.background.Done()
+
+	for {
+		src, message := s.take()
+		if message == nil {
+			select {
+			case <-s.ready:
+				continue
+			case <-s.cg.stopper:
+				return
+			}
+		}
+
+		// The queued messages are held while the circuit breaker is open.
+		delivered := false
+		if s.cg.breaker.admit(s.cg.stopper, src.removed, message) {
+			select {
+			case s.cg.messages <- message:
+				delivered = true
+			case <-src.removed:
+			case <-s.cg.stopper:
+			}
+		}
+
+		s.l.Lock()
+		if delivered {
+			src.delivered = message.Offset
+		}
+		close(src.sending)
+		src.sending = nil
+		s.l.Unlock()
+	}
+}
+
+// take takes the next message to deliver from the queues, or returns nil if they are
+// all empty.
+func (s *scheduler) take() (*source, *sarama.ConsumerMessage) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	top := math.MinInt
+	for _, src := range s.sources {
+		if len(src.queue) > 0 && src.priority > top {
+			top = src.priority
+		}
+	}
+	if top == math.MinInt {
+		return nil, nil
+	}
+
+	// Every source of the top priority may deliver as many messages as its weight per
+	// round. A new round starts when none of them has credit left.
+	for round := 0; round < 2; round++ {
+		for i := range s.sources {
+			n := (s.next + i) % len(s.sources)
+			src := s.sources[n]
+			if src.priority != top || len(src.queue) == 0 || src.credit <= 0 {
+				continue
+			}
+
+			src.credit--
+			s.next = n
+			if src.credit == 0 {
+				s.next = n + 1
+			}
+			src.sending = make(chan struct{})
+			message := <-src.queue
+			s.updateDepth(src)
+			return src, message
+		}
+
+		for _, src := range s.sources {
+			if src.priority == top {
+				src.credit = src.weight
+			}
+		}
+	}
+	return nil, nil
+}
+
+// enqueue queues a message, and waits while the queue of its partition is full. It
+// returns false if the partition consumer stopped first.
+func (s *scheduler) enqueue(done <-chan struct{}, message *sarama.ConsumerMessage) bool {
+	src := s.source(message.Topic, message.Partition)
+	select {
+	case src.queue <- message:
+	case <-done:
+		return false
+	}
+
+	s.l.Lock()
+	s.updateDepth(src)
+	s.l.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *scheduler) source(topic string, partition int32) *source {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	for _, src := range s.sources {
+		if src.topic == topic && src.partition == partition {
+			return src
+		}
+	}
+
+	src := &source{
+		topic:     topic,
+		partition: partition,
+		weight:    1,
+		queue:     make(chan *sarama.ConsumerMessage, s.cg.config.ChannelBufferSize),
+		removed:   make(chan struct{}),
+		delivered: -1,
+	}
+	if tc := s.cg.config.Topics[topic]; tc != nil {
+		src.priority = tc.Priority
+		if tc.Weight > 0 {
+			src.weight = tc.Weight
+		}
+	}
+	src.credit = src.weight
+	s.sources = append(s.sources, src)
+	return src
+}
+
+// remove drops the queued messages of a partition, and returns the offset of the last
+// message that was delivered. It returns false if no message was queued.
+func (s *scheduler) remove(topic string, partition int32) (int64, bool) {
+	s.l.Lock()
+	var src *source
+	for i, candidate := range s.sources {
+		if candidate.topic == topic && candidate.partition == partition {
+			src = candidate
+			s.sources = append(s.sources[:i], s.sources[i+1:]...)
+			break
+		}
+	}
+	if src == nil {
+		s.l.Unlock()
+		return -1, false
+	}
+	close(src.removed)
+	sending := src.sending
+	s.l.Unlock()
+
+	// Wait for the message that is being delivered, if any.
+	if sending != nil {
+		<-sending
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	registry := s.cg.config.MetricRegistry
+	if registry == nil {
+		registry = metrics.DefaultRegistry
+	}
+	registry.Unregister(queueDepthMetric(src))
+	return src.delivered, true
+}
+
+// updateDepth reports the number of queued messages of a partition. The caller must hold
+// the lock.
+func (s *scheduler) updateDepth(src *source) {
+	metrics.GetOrRegisterGauge(queueDepthMetric(src), s.cg.config.MetricRegistry).Update(int64(len(src.queue)))
+}
+
+func queueDepthMetric(src *source) string {
+	return fmt.Sprintf("consumergroup-queue-depth.%s.%d", src.topic, src.partition)
+}
@@ -0,0 +1,139 @@
+package consumergroup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestSchedulerPrioritiesAndWeights(t *testing.T) {
+	config := NewConfig()
+	config.Scheduler.Enabled = true
+	config.Topics = map[string]*TopicConfig{
+		"control": {Priority: 1},
+		"events":  {Weight: 2},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cg, _ := newMockConsumerGroup("ScheduledConsumerGroup", []string{"events", "logs", "control"}, nil, config)
+
+	for offset := int64(0); offset < 4; offset++ {
+		cg.scheduler.enqueue(nil, &sarama.ConsumerMessage{Topic: "events", Offset: offset})
+		cg.scheduler.enqueue(nil, &sarama.ConsumerMessage{Topic: "logs", Offset: offset})
+	}
+	cg.scheduler.enqueue(nil, &sarama.ConsumerMessage{Topic: "control", Offset: 0})
+
+	if depth := metrics.GetOrRegisterGauge("consumergroup-queue-depth.events.0", config.MetricRegistry).Value(); depth != 4 {
+		t.Errorf("Expected 4 queued messages, got %d", depth)
+	}
+
+	cg.background.Add(1)
+	go cg.scheduler.run()
+
+	expected := []string{"control", "events", "events", "logs", "events", "events", "logs", "logs", "logs"}
+	for i, topic := range expected {
+		if message := <-cg.messages; message.Topic != topic {
+			t.Fatalf("Expected message %d to be from %s, got %s", i, topic, message.Topic)
+		}
+	}
+
+	if delivered, ok := cg.scheduler.remove("logs", 0); !ok || delivered != 3 {
+		t.Errorf("Expected the last delivered offset to be 3, got %d", delivered)
+	}
+
+	close(cg.stopper)
+	cg.background.Wait()
+}
+
+func TestSchedulerRemoveDuringSendAndClaimAgain(t *testing.T) {
+	config := NewConfig()
+	config.Scheduler.Enabled = true
+	cg, _ := newMockConsumerGroup("ScheduledConsumerGroup", []string{"events"}, nil, config)
+	if cap(cg.messages) != 0 {
+		t.Fatalf("Expected the messages channel to be unbuffered, got capacity %d", cap(cg.messages))
+	}
+
+	depth := metrics.GetOrRegisterGauge("consumergroup-queue-depth.events.0", config.MetricRegistry)
+	waitForEmptyQueue := func() {
+		for deadline := time.Now().Add(5 * time.Second); depth.Value() > 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Timeout waiting for the scheduler to take the queued messages")
+			}
+		}
+	}
+
+	cg.background.Add(1)
+	go cg.scheduler.run()
+
+	for offset := int64(0); offset < 2; offset++ {
+		cg.scheduler.enqueue(nil, &sarama.ConsumerMessage{Topic: "events", Offset: offset})
+	}
+	if message := <-cg.messages; message.Offset != 0 {
+		t.Fatalf("Expected offset 0, got %d", message.Offset)
+	}
+
+	// Offset 1 is being sent while the partition is released.
+	waitForEmptyQueue()
+	if delivered, ok := cg.scheduler.remove("events", 0); !ok || delivered != 0 {
+		t.Errorf("Expected the last delivered offset to be 0, got %d", delivered)
+	}
+	select {
+	case message := <-cg.messages:
+		t.Fatalf("Expected the message of the released partition to be dropped, got offset %d", message.Offset)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// The partition is claimed again, and consumed from the first undelivered message.
+	cg.scheduler.enqueue(nil, &sarama.ConsumerMessage{Topic: "events", Offset: 1})
+	if message := <-cg.messages; message.Offset != 1 {
+		t.Fatalf("Expected offset 1 to be delivered again, got %d", message.Offset)
+	}
+	waitForEmptyQueue()
+	if delivered, ok := cg.scheduler.remove("events", 0); !ok || delivered != 1 {
+		t.Errorf("Expected the last delivered offset to be 1, got %d", delivered)
+	}
+
+	close(cg.stopper)
+	cg.background.Wait()
+}
+
+func TestSchedulerHoldsQueuesWhileBreakerIsOpen(t *testing.T) {
+	config := NewConfig()
+	config.Scheduler.Enabled = true
+	config.Breaker.Enabled = true
+	config.Breaker.ProbeInterval = time.Minute
+	cg, _ := newMockConsumerGroup("ScheduledConsumerGroup", []string{"events"}, nil, config)
+
+	cg.breaker.l.Lock()
+	cg.breaker.setState(BreakerOpen)
+	cg.breaker.l.Unlock()
+
+	cg.background.Add(1)
+	go cg.scheduler.run()
+
+	cg.scheduler.enqueue(nil, &sarama.ConsumerMessage{Topic: "events", Offset: 0})
+	select {
+	case message := <-cg.messages:
+		t.Fatalf("Expected the queued message to be held while the breaker is open, got offset %d", message.Offset)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cg.breaker.l.Lock()
+	cg.breaker.setState(BreakerClosed)
+	cg.breaker.l.Unlock()
+	select {
+	case message := <-cg.messages:
+		if message.Offset != 0 {
+			t.Errorf("Expected offset 0, got %d", message.Offset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the queued message to be delivered once the breaker closed")
+	}
+
+	close(cg.stopper)
+	cg.background.Wait()
+}
@@ -0,0 +1,62 @@
+package consumergroup
+
+import "testing"
+
+type recordingConsumerGroupManager struct {
+	mockConsumerGroupManager
+	commits int
+}
+
+func (cgm *recordingConsumerGroupManager) CommitOffset(string, int32, int64, int32, int32) error {
+	cgm.commits++
+	return nil
+}
+
+func TestShadowNeverCommits(t *testing.T) {
+	config := NewConfig()
+	config.Shadow.Enabled = true
+
+	group := &recordingConsumerGroupManager{}
+	cg, _ := newMockConsumerGroup("ShadowConsumerGroup", []string{"Topic"}, nil, config)
+	cg.group = group
+
+	if _, err := cg.offsetManager.InitializePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+	cg.offsetManager.MarkAsProcessed("Topic", 0, 10)
+	if err := cg.offsetManager.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cg.RewindOffset("Topic", 0, 5); err != ShadowReadOnly {
+		t.Errorf("Expected ShadowReadOnly, got %v", err)
+	}
+	if group.commits != 0 {
+		t.Errorf("Expected the shadow not to commit offsets, got %d commits", group.commits)
+	}
+	if cg.registers() || cg.claimsPartitions() {
+		t.Error("Expected the shadow not to register or claim partitions")
+	}
+}
+
+func TestShadowValidation(t *testing.T) {
+	config := NewConfig()
+	config.Shadow.Enabled = true
+	config.Instance.Standby = true
+	config.Instance.ActiveInstances = 2
+	if err := config.Validate(); err == nil {
+		t.Error("Expected Shadow and Instance.Standby to be rejected together")
+	}
+
+	config = NewConfig()
+	config.Shadow.Enabled = true
+	config.Poison.MaxAttempts = 3
+	if err := config.Validate(); err == nil {
+		t.Error("Expected Shadow and Poison to be rejected together")
+	}
+
+	config = NewConfig()
+	config.Shadow.Enabled = true
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected a shadow instance to be valid, got %v", err)
+	}
+}
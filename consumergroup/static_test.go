@@ -0,0 +1,84 @@
+package consumergroup
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// watchCountingConsumerGroupManager counts how often the instances are watched.
+type watchCountingConsumerGroupManager struct {
+	mockConsumerGroupManager
+	watches atomic.Int32
+}
+
+func (cgm *watchCountingConsumerGroupManager) WatchInstances() ([]*Member, <-chan zk.Event, error) {
+	cgm.watches.Add(1)
+	return cgm.mockConsumerGroupManager.WatchInstances()
+}
+
+func TestStaticAssignment(t *testing.T) {
+	config := NewConfig()
+	config.StaticAssignment = map[string][]int32{"Topic": {0, 2}}
+
+	if _, err := JoinConsumerGroup("StaticConsumerGroup", []string{"Topic", "Other"}, []string{"localhost:2181"}, config, newMockConsumerGroup); err == nil {
+		t.Error("Expected a topic without a static assignment to be rejected")
+	}
+
+	cg, _ := newMockConsumerGroup("StaticConsumerGroup", []string{"Topic"}, nil, config)
+	partitions := cg.staticPartitions("Topic", partitionLeaders{{ID: 0}, {ID: 1}})
+	if len(partitions) != 1 || partitions[0].ID != 0 {
+		t.Errorf("Expected only partition 0 to be consumed, got %v", partitions)
+	}
+
+	select {
+	case err := <-cg.Errors():
+		if ce, ok := err.(*sarama.ConsumerError); !ok || ce.Partition != 2 || ce.Err != sarama.ErrUnknownTopicOrPartition {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	default:
+		t.Error("Expected the missing partition to be reported")
+	}
+}
+
+func TestStaticInstanceDoesNotRebalance(t *testing.T) {
+	config := NewConfig()
+	config.StaticAssignment = map[string][]int32{"Topic": {0}}
+	config.Notifications.Enabled = true
+	group := &watchCountingConsumerGroupManager{}
+
+	consumer, err := JoinConsumerGroup(
+		"StaticConsumerGroup",
+		[]string{"Topic"},
+		[]string{"localhost:2181"},
+		config,
+		func(name string, topics []string, zookeeper []string, config *Config) (*ConsumerGroup, error) {
+			cg, err := newMockConsumerGroup(name, topics, zookeeper, config)
+			if err == nil {
+				cg.consumer = &idleConsumer{}
+				cg.kazoo = &partitionTopicReader{}
+				cg.group = group
+			}
+			return cg, err
+		})
+	if err != nil {
+		t.Fatal("Could not start consumer")
+	}
+	defer consumer.Close()
+
+	expectNotification(t, consumer, &RebalanceStart{})
+	expectNotification(t, consumer, &RebalanceEnd{Assignment: map[string][]int32{"Topic": {0}}})
+	expectNotification(t, consumer, &PartitionClaimed{Topic: "Topic", Partition: 0})
+
+	select {
+	case n := <-consumer.Notifications():
+		t.Errorf("Expected the static instance to keep its partitions, got %#v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if watches := group.watches.Load(); watches != 0 {
+		t.Errorf("Expected the static instance not to watch the instances, but it did %d times", watches)
+	}
+}
@@ -0,0 +1,193 @@
+package consumergroup
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"golang.org/x/time/rate"
+)
+
+// A Throttle limits the rate at which messages are delivered. Zero values do not limit
+// the rate.
+type Throttle struct {
+	Messages float64 // Messages per second.
+	Bytes    float64 // Bytes of message keys and values per second.
+}
+
+func (t Throttle) validate(name string) error {
+	if t.Messages < 0 || t.Bytes < 0 {
+		return sarama.ConfigurationError(fmt.Sprintf("%s should be >= 0", name))
+	}
+	return nil
+}
+
+// override returns the throttle with the rates that are set in o replaced.
+func (t Throttle) override(o Throttle) Throttle {
+	if o.Messages != 0 {
+		t.Messages = o.Messages
+	}
+	if o.Bytes != 0 {
+		t.Bytes = o.Bytes
+	}
+	return t
+}
+
+// SetGroupThrottle changes the limit of the delivery of the messages of all topics
+// together. A zero Throttle removes the limit.
+func (cg *ConsumerGroup) SetGroupThrottle(t Throttle) error {
+	if err := t.validate("Throttle"); err != nil {
+		return err
+	}
+	cg.throttles.group().set(t)
+	return nil
+}
+
+// SetTopicThrottle changes the limit of the delivery of the messages of a topic. A zero
+// Throttle removes the limit.
+func (cg *ConsumerGroup) SetTopicThrottle(topic string, t Throttle) error {
+	if err := t.validate("Throttle"); err != nil {
+		return err
+	}
+	cg.throttles.topic(topic).set(t)
+	return nil
+}
+
+// SetPartitionThrottle changes the limit of the delivery of the messages of a partition.
+// The limit is kept when the partition is claimed again after a rebalance. A zero
+// Throttle removes the limit.
+func (cg *ConsumerGroup) SetPartitionThrottle(topic string, partition int32, t Throttle) error {
+	if err := t.validate("Throttle"); err != nil {
+		return err
+	}
+	cg.throttles.partition(topic, partition).set(t)
+	return nil
+}
+
+// throttles holds the rate limiters of the group, its topics, and its partitions. They
+// are created from the configuration when they are first needed.
+type throttles struct {
+	config *Config
+
+	l          sync.Mutex
+	all        *limiter
+	topics     map[string]*limiter
+	partitions map[string]map[int32]*limiter
+}
+
+func newThrottles(config *Config) *throttles {
+	return &throttles{
+		config:     config,
+		topics:     make(map[string]*limiter),
+		partitions: make(map[string]map[int32]*limiter),
+	}
+}
+
+func (ts *throttles) group() *limiter {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+
+	if ts.all == nil {
+		ts.all = newLimiter(ts.config.Throttle.Group)
+	}
+	return ts.all
+}
+
+func (ts *throttles) topic(topic string) *limiter {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+
+	l := ts.topics[topic]
+	if l == nil {
+		t := ts.config.Throttle.Topic
+		if tc := ts.config.Topics[topic]; tc != nil {
+			t = t.override(tc.Throttle)
+		}
+		l = newLimiter(t)
+		ts.topics[topic] = l
+	}
+	return l
+}
+
+func (ts *throttles) partition(topic string, partition int32) *limiter {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+
+	if ts.partitions[topic] == nil {
+		ts.partitions[topic] = make(map[int32]*limiter)
+	}
+	l := ts.partitions[topic][partition]
+	if l == nil {
+		t := ts.config.Throttle.Partition
+		if tc := ts.config.Topics[topic]; tc != nil {
+			t = t.override(tc.PartitionThrottle)
+		}
+		l = newLimiter(t)
+		ts.partitions[topic][partition] = l
+	}
+	return l
+}
+
+// wait waits until the message may be delivered under the limits of its partition, its
+// topic, and the group.
+func (ts *throttles) wait(ctx context.Context, message *sarama.ConsumerMessage) error {
+	size := len(message.Key) + len(message.Value)
+	for _, l := range []*limiter{ts.partition(message.Topic, message.Partition), ts.topic(message.Topic), ts.group()} {
+		if err := l.wait(ctx, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limiter limits messages and bytes per second.
+type limiter struct {
+	messages *rate.Limiter
+	bytes    *rate.Limiter
+}
+
+func newLimiter(t Throttle) *limiter {
+	l := &limiter{messages: rate.NewLimiter(rate.Inf, 1), bytes: rate.NewLimiter(rate.Inf, 1)}
+	l.set(t)
+	return l
+}
+
+// set changes the limits of the messages that are delivered from now on.
+func (l *limiter) set(t Throttle) {
+	setRate(l.messages, t.Messages)
+	setRate(l.bytes, t.Bytes)
+}
+
+// setRate allows bursts of up to a second's worth of the rate.
+func setRate(l *rate.Limiter, perSecond float64) {
+	if perSecond == 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetLimit(rate.Limit(perSecond))
+	l.SetBurst(int(math.Max(1, math.Ceil(perSecond))))
+}
+
+func (l *limiter) wait(ctx context.Context, size int) error {
+	if err := l.messages.Wait(ctx); err != nil {
+		return err
+	}
+	if l.bytes.Limit() == rate.Inf {
+		return nil
+	}
+
+	// Messages larger than the burst are let through in parts.
+	for size > 0 {
+		n := min(size, l.bytes.Burst())
+		if err := l.bytes.WaitN(ctx, n); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			continue // The burst was lowered in the meantime.
+		}
+		size -= n
+	}
+	return nil
+}
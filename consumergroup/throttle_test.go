@@ -0,0 +1,65 @@
+package consumergroup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"golang.org/x/time/rate"
+)
+
+func TestThrottles(t *testing.T) {
+	config := NewConfig()
+	config.Throttle.Topic = Throttle{Messages: 100, Bytes: 1000}
+	config.Throttle.Partition = Throttle{Messages: 50}
+	config.Topics = map[string]*TopicConfig{"replay": {Throttle: Throttle{Messages: 10}}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.Topics["replay"].PartitionThrottle.Bytes = -1
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a negative rate to be rejected")
+	}
+	config.Topics["replay"].PartitionThrottle.Bytes = 0
+
+	cg, _ := newMockConsumerGroup("ThrottledConsumerGroup", []string{"replay"}, nil, config)
+
+	topic := cg.throttles.topic("replay")
+	if topic.messages.Limit() != 10 || topic.bytes.Limit() != 1000 {
+		t.Errorf("Expected the topic to override only the message rate, got %v and %v", topic.messages.Limit(), topic.bytes.Limit())
+	}
+	if limit := cg.throttles.partition("replay", 0).messages.Limit(); limit != 50 {
+		t.Errorf("Expected the partition rate of the group, got %v", limit)
+	}
+	if limit := cg.throttles.group().messages.Limit(); limit != rate.Inf {
+		t.Errorf("Expected the group not to be limited, got %v", limit)
+	}
+
+	if err := cg.SetTopicThrottle("replay", Throttle{}); err != nil {
+		t.Fatal(err)
+	}
+	if topic.messages.Limit() != rate.Inf || topic.bytes.Limit() != rate.Inf {
+		t.Error("Expected the topic limit to be removed at runtime")
+	}
+
+	if err := cg.SetPartitionThrottle("replay", 0, Throttle{Messages: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	message := &sarama.ConsumerMessage{Topic: "replay", Partition: 0, Value: []byte("value")}
+	start := time.Now()
+	for i := 0; i < 1050; i++ {
+		if err := cg.throttles.wait(context.Background(), message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected the messages beyond the burst to be throttled, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cg.throttles.wait(ctx, message); err == nil {
+		t.Error("Expected waiting to stop when the partition consumer stops")
+	}
+}
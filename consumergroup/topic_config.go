@@ -0,0 +1,244 @@
+package consumergroup
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// OutOfRangePolicy decides where to continue consuming a partition when the offset to
+// resume from is not available anymore, e.g. because it was removed by retention.
+type OutOfRangePolicy int
+
+const (
+	// OutOfRangeInitial continues from the oldest offset if the initial offset of the topic
+	// is sarama.OffsetOldest, and from the newest offset otherwise. This is the default.
+	OutOfRangeInitial OutOfRangePolicy = iota
+	// OutOfRangeOldest continues from the oldest available offset.
+	OutOfRangeOldest
+	// OutOfRangeNewest continues from the newest offset, skipping the available messages.
+	OutOfRangeNewest
+	// OutOfRangeFail stops consuming the partition, and reports sarama.ErrOffsetOutOfRange
+	// on the errors channel.
+	OutOfRangeFail
+	// OutOfRangeCallback asks the OnOutOfRange callback where to continue.
+	OutOfRangeCallback
+)
+
+// An OutOfRangeHandler decides where to continue consuming a partition whose offset is
+// not available anymore. It returns the offset to continue from, which may be
+// sarama.OffsetOldest or sarama.OffsetNewest, or an error to stop consuming the partition.
+type OutOfRangeHandler func(topic string, partition int32, offset int64) (int64, error)
+
+// TopicConfig overrides the configuration of the consumer group for a single topic. Zero
+// values keep the configuration of the group.
+type TopicConfig struct {
+	Initial           int64             // Overrides Offsets.Initial. Must be either sarama.OffsetOldest or sarama.OffsetNewest if set.
+	ProcessingTimeout time.Duration     // Overrides Offsets.ProcessingTimeout.
+	OutOfRange        OutOfRangePolicy  // Overrides Offsets.OutOfRange.
+	OnOutOfRange      OutOfRangeHandler // Overrides Offsets.OnOutOfRange.
+	Throttle          Throttle          // Overrides Throttle.Topic.
+	PartitionThrottle Throttle          // Overrides Throttle.Partition.
+	Priority          int               // With Scheduler.Enabled, messages of topics with a higher priority are delivered before those of other topics. Defaults to 0.
+	Weight            int               // With Scheduler.Enabled, the number of messages delivered from every partition of the topic per turn, among the partitions of the same priority. Defaults to 1.
+
+	// Overrides the fetch settings of the sarama configuration. Topics that override them
+	// are consumed with a Kafka client of their own.
+	Fetch struct {
+		Min         int32         // Overrides Consumer.Fetch.Min.
+		Default     int32         // Overrides Consumer.Fetch.Default.
+		Max         int32         // Overrides Consumer.Fetch.Max.
+		MaxWaitTime time.Duration // Overrides Consumer.MaxWaitTime.
+	}
+}
+
+func (tc *TopicConfig) validate(topic string, base *sarama.Config) error {
+	if tc.Initial != 0 && tc.Initial != sarama.OffsetOldest && tc.Initial != sarama.OffsetNewest {
+		return sarama.ConfigurationError(fmt.Sprintf("Topics[%s].Initial should be sarama.OffsetOldest or sarama.OffsetNewest", topic))
+	}
+
+	if tc.ProcessingTimeout < 0 {
+		return sarama.ConfigurationError(fmt.Sprintf("Topics[%s].ProcessingTimeout should have a duration >= 0", topic))
+	}
+
+	if !tc.OutOfRange.valid() {
+		return sarama.ConfigurationError(fmt.Sprintf("Topics[%s].OutOfRange is not a valid policy", topic))
+	}
+
+	if err := tc.Throttle.validate(fmt.Sprintf("Topics[%s].Throttle", topic)); err != nil {
+		return err
+	}
+
+	if err := tc.PartitionThrottle.validate(fmt.Sprintf("Topics[%s].PartitionThrottle", topic)); err != nil {
+		return err
+	}
+
+	if tc.Weight < 0 {
+		return sarama.ConfigurationError(fmt.Sprintf("Topics[%s].Weight should be >= 0", topic))
+	}
+
+	if tc.Fetch.Min < 0 || tc.Fetch.Default < 0 || tc.Fetch.Max < 0 || tc.Fetch.MaxWaitTime < 0 {
+		return sarama.ConfigurationError(fmt.Sprintf("Topics[%s].Fetch settings should be >= 0", topic))
+	}
+
+	if config := tc.saramaConfig(base); config != nil {
+		if err := config.Validate(); err != nil {
+			return sarama.ConfigurationError(fmt.Sprintf("Topics[%s].Fetch: %s", topic, err))
+		}
+	}
+
+	return nil
+}
+
+// saramaConfig returns a copy of the sarama configuration with the fetch settings of the
+// topic, or nil if the topic does not override them.
+func (tc *TopicConfig) saramaConfig(base *sarama.Config) *sarama.Config {
+	if base == nil || (tc.Fetch.Min == 0 && tc.Fetch.Default == 0 && tc.Fetch.Max == 0 && tc.Fetch.MaxWaitTime == 0) {
+		return nil
+	}
+
+	config := *base
+	if tc.Fetch.Min > 0 {
+		config.Consumer.Fetch.Min = tc.Fetch.Min
+	}
+	if tc.Fetch.Default > 0 {
+		config.Consumer.Fetch.Default = tc.Fetch.Default
+	}
+	if tc.Fetch.Max > 0 {
+		config.Consumer.Fetch.Max = tc.Fetch.Max
+	}
+	if tc.Fetch.MaxWaitTime > 0 {
+		config.Consumer.MaxWaitTime = tc.Fetch.MaxWaitTime
+	}
+	return &config
+}
+
+func (p OutOfRangePolicy) valid() bool {
+	return p >= OutOfRangeInitial && p <= OutOfRangeCallback
+}
+
+// initialOffset returns the offset to start consuming a topic from when no offset has
+// been committed.
+func (cgc *Config) initialOffset(topic string) int64 {
+	if tc := cgc.Topics[topic]; tc != nil && tc.Initial != 0 {
+		return tc.Initial
+	}
+	if cgc.Broadcast.Enabled {
+		return cgc.Broadcast.Initial
+	}
+	return cgc.Offsets.Initial
+}
+
+// processingTimeout returns the time to wait for the messages of a partition of the
+// topic to be processed.
+func (cgc *Config) processingTimeout(topic string) time.Duration {
+	if tc := cgc.Topics[topic]; tc != nil && tc.ProcessingTimeout != 0 {
+		return tc.ProcessingTimeout
+	}
+	return cgc.Offsets.ProcessingTimeout
+}
+
+// maxWaitTime returns the time the broker waits for new messages of a partition of the
+// topic before it answers a fetch.
+func (cgc *Config) maxWaitTime(topic string) time.Duration {
+	if tc := cgc.Topics[topic]; tc != nil && tc.Fetch.MaxWaitTime > 0 {
+		return tc.Fetch.MaxWaitTime
+	}
+	if cgc.Config == nil {
+		return sarama.NewConfig().Consumer.MaxWaitTime
+	}
+	return cgc.Consumer.MaxWaitTime
+}
+
+// outOfRangePolicy returns the out-of-range policy of the topic, and the callback to use
+// with OutOfRangeCallback.
+func (cgc *Config) outOfRangePolicy(topic string) (OutOfRangePolicy, OutOfRangeHandler) {
+	policy, handler := cgc.Offsets.OutOfRange, cgc.Offsets.OnOutOfRange
+	if tc := cgc.Topics[topic]; tc != nil {
+		if tc.OutOfRange != OutOfRangeInitial {
+			policy = tc.OutOfRange
+		}
+		if tc.OnOutOfRange != nil {
+			handler = tc.OnOutOfRange
+		}
+	}
+	return policy, handler
+}
+
+// outOfRangeOffset returns the offset to continue consuming a partition of the topic from
+// when the offset is out of range, or an error if the partition should not be consumed.
+func (cgc *Config) outOfRangeOffset(topic string, partition int32, offset int64) (int64, error) {
+	policy, handler := cgc.outOfRangePolicy(topic)
+	switch policy {
+	case OutOfRangeOldest:
+		return sarama.OffsetOldest, nil
+	case OutOfRangeNewest:
+		return sarama.OffsetNewest, nil
+	case OutOfRangeFail:
+		return -1, sarama.ErrOffsetOutOfRange
+	case OutOfRangeCallback:
+		return handler(topic, partition, offset)
+	default:
+		if cgc.initialOffset(topic) == sarama.OffsetOldest {
+			return sarama.OffsetOldest, nil
+		}
+		return sarama.OffsetNewest, nil
+	}
+}
+
+// fetchConsumer consumes a topic that overrides the fetch settings.
+type fetchConsumer struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+}
+
+// newFetchConsumers creates a consumer for every topic that overrides the fetch settings.
+func newFetchConsumers(brokers []string, topics []string, config *Config) (map[string]*fetchConsumer, error) {
+	result := make(map[string]*fetchConsumer)
+	for _, topic := range topics {
+		tc := config.Topics[topic]
+		if tc == nil {
+			continue
+		}
+		saramaConfig := tc.saramaConfig(config.Config)
+		if saramaConfig == nil {
+			continue
+		}
+
+		client, err := sarama.NewClient(brokers, saramaConfig)
+		if err != nil {
+			_ = closeFetchConsumers(result)
+			return nil, err
+		}
+		consumer, err := sarama.NewConsumerFromClient(client)
+		if err != nil {
+			_ = client.Close()
+			_ = closeFetchConsumers(result)
+			return nil, err
+		}
+		result[topic] = &fetchConsumer{client: client, consumer: consumer}
+	}
+	return result, nil
+}
+
+func closeFetchConsumers(consumers map[string]*fetchConsumer) error {
+	var result error
+	for _, fc := range consumers {
+		if err := fc.consumer.Close(); err != nil {
+			result = err
+		}
+		if err := fc.client.Close(); err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// consumerFor returns the consumer for a topic.
+func (cg *ConsumerGroup) consumerFor(topic string) sarama.Consumer {
+	if fc := cg.fetchConsumers[topic]; fc != nil {
+		return fc.consumer
+	}
+	return cg.consumer
+}
@@ -0,0 +1,94 @@
+package consumergroup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestTopicConfigOverrides(t *testing.T) {
+	config := NewConfig()
+	control := &TopicConfig{Initial: sarama.OffsetNewest, ProcessingTimeout: 5 * time.Second, OutOfRange: OutOfRangeOldest}
+	control.Fetch.Default = 1024
+	config.Topics = map[string]*TopicConfig{"control": control}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.initialOffset("control") != sarama.OffsetNewest || config.initialOffset("events") != sarama.OffsetOldest {
+		t.Error("Expected only the control topic to start from the newest offset")
+	}
+	if config.processingTimeout("control") != 5*time.Second || config.processingTimeout("events") != config.Offsets.ProcessingTimeout {
+		t.Error("Expected only the control topic to override the processing timeout")
+	}
+	if offset, _ := config.outOfRangeOffset("control", 0, 5); offset != sarama.OffsetOldest {
+		t.Error("Expected the control topic to continue from the oldest offset when out of range")
+	}
+	if offset, _ := config.outOfRangeOffset("events", 0, 5); offset != sarama.OffsetOldest {
+		t.Error("Expected the events topic to continue from its initial offset when out of range")
+	}
+
+	if sc := control.saramaConfig(config.Config); sc == nil || sc.Consumer.Fetch.Default != 1024 || config.Consumer.Fetch.Default == 1024 {
+		t.Error("Expected the fetch settings to be overridden for the control topic only")
+	}
+	if (&TopicConfig{}).saramaConfig(config.Config) != nil {
+		t.Error("Expected no separate sarama configuration without fetch overrides")
+	}
+
+	control.Initial = 5
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an invalid initial offset to be rejected")
+	}
+	control.Initial = 0
+	control.Fetch.Max = -1
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a negative fetch size to be rejected")
+	}
+}
+
+type outOfRangeConsumer struct {
+	mockSaramaConsumer
+	unavailable int64
+}
+
+func (c *outOfRangeConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	if offset == c.unavailable {
+		return nil, sarama.ErrOffsetOutOfRange
+	}
+	return nil, nil
+}
+
+func TestOutOfRangePolicies(t *testing.T) {
+	config := NewConfig()
+	config.Notifications.Enabled = true
+	config.Offsets.OutOfRange = OutOfRangeCallback
+	if err := config.Validate(); err == nil {
+		t.Error("Expected OutOfRangeCallback without a callback to be rejected")
+	}
+	config.Offsets.OnOutOfRange = func(topic string, partition int32, offset int64) (int64, error) {
+		return offset + 37, nil
+	}
+	config.Topics = map[string]*TopicConfig{"control": {OutOfRange: OutOfRangeFail}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cg, _ := newMockConsumerGroup("OutOfRangeConsumerGroup", []string{"events", "control"}, nil, config)
+	cg.consumer = &outOfRangeConsumer{unavailable: 5}
+
+	if _, err := cg.consumePartition("control", 0, 5); err != sarama.ErrOffsetOutOfRange {
+		t.Errorf("Expected the control partition to fail, got %v", err)
+	}
+	if err := <-cg.Errors(); err.(*sarama.ConsumerError).Err != sarama.ErrOffsetOutOfRange {
+		t.Errorf("Expected the failure to be reported, got %v", err)
+	}
+
+	if _, err := cg.consumePartition("events", 0, 5); err != nil {
+		t.Fatal(err)
+	}
+	<-cg.Notifications() // OffsetReset
+	if loss, ok := (<-cg.Notifications()).(*DataLoss); !ok || loss.From != 5 || loss.To != 42 {
+		t.Errorf("Expected the skipped messages to be reported, got %#v", loss)
+	}
+}
@@ -6,66 +6,50 @@ import (
 	"io"
 	"os"
 	"sort"
-
-	"github.com/wvanbergen/kazoo-go"
 )
 
-// Divides a set of partitions between a set of consumers.
-func dividePartitionsBetweenConsumers(consumers kazoo.ConsumergroupInstanceList, partitions partitionLeaders) map[string][]*kazoo.Partition {
-	result := make(map[string][]*kazoo.Partition)
-
-	plen := len(partitions)
-	clen := len(consumers)
-	if clen == 0 {
+// Divides a set of partitions between a set of consumers, in proportion to their weight.
+func dividePartitionsBetweenConsumers(consumers []*Member, partitions partitionLeaders) map[string][]*Partition {
+	result := make(map[string][]*Partition)
+	if len(consumers) == 0 {
 		return result
 	}
 
 	sort.Sort(partitions)
-	sort.Sort(consumers)
+	sortMembers(consumers)
 
-	n := plen / clen
-	m := plen % clen
 	p := 0
-	for i, consumer := range consumers {
+	for i, quota := range quotas(consumers, len(partitions)) {
 		first := p
-		last := first + n
-		if m > 0 && i < m {
-			last++
-		}
-		if last > plen {
-			last = plen
-		}
+		last := first + quota
 
-		for _, pl := range partitions[first:last] {
-			result[consumer.ID] = append(result[consumer.ID], pl.partition)
-		}
+		result[consumers[i].ID] = append(result[consumers[i].ID], partitions[first:last]...)
 		p = last
 	}
 
 	return result
 }
 
-type partitionLeader struct {
-	id        int32
-	leader    int32
-	partition *kazoo.Partition
-}
-
-// A sortable slice of PartitionLeader structs
-type partitionLeaders []partitionLeader
+// A sortable slice of partitions, ordered by leader and ID.
+type partitionLeaders []*Partition
 
 func (pls partitionLeaders) Len() int {
 	return len(pls)
 }
 
 func (pls partitionLeaders) Less(i, j int) bool {
-	return pls[i].leader < pls[j].leader || (pls[i].leader == pls[j].leader && pls[i].id < pls[j].id)
+	return pls[i].Leader < pls[j].Leader || (pls[i].Leader == pls[j].Leader && pls[i].ID < pls[j].ID)
 }
 
 func (s partitionLeaders) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 
+// sortMembers sorts a list of members by ID.
+func sortMembers(members []*Member) {
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+}
+
 // generateUUID Generates a UUIDv4.
 func generateUUID() (string, error) {
 	uuid := make([]byte, 16)
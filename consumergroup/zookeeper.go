@@ -0,0 +1,628 @@
+package consumergroup
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/wvanbergen/kazoo-go"
+)
+
+// zookeeperConn is the part of *zk.Conn the consumer group uses.
+type zookeeperConn interface {
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	CreateProtectedEphemeralSequential(path string, data []byte, acl []zk.ACL) (string, error)
+	Delete(path string, version int32) error
+	Exists(path string) (bool, *zk.Stat, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	Multi(ops ...interface{}) ([]zk.MultiResponse, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+}
+
+// zookeeperGroup manages a consumer group in Zookeeper using the same layout as kazoo.
+// Unlike kazoo it is backed by a connection the consumer group owns, so the state of
+// the session that holds the ephemeral registration and claims can be observed.
+type zookeeperGroup struct {
+	conn   zookeeperConn
+	chroot string
+	name   string
+}
+
+func newZookeeperGroup(conn zookeeperConn, chroot string, name string) *zookeeperGroup {
+	return &zookeeperGroup{conn: conn, chroot: chroot, name: name}
+}
+
+func (g *zookeeperGroup) node(format string, args ...interface{}) string {
+	return fmt.Sprintf("%s/consumers/%s", g.chroot, g.name) + fmt.Sprintf(format, args...)
+}
+
+func (g *zookeeperGroup) Exists() (bool, error) {
+	exists, _, err := g.conn.Exists(g.node(""))
+	return exists, err
+}
+
+func (g *zookeeperGroup) Create() error {
+	return g.mkdirRecursive(g.node(""))
+}
+
+// CommitOffset stores the offset only if the partition has not been claimed again
+// since the claim with the given epoch was made, and the offset node still has the
+// given version, as returned by FetchOffsetVersion. An epoch or version of -1 skips
+// the check. It returns offsetChanged if the offset node was changed in the meantime.
+func (g *zookeeperGroup) CommitOffset(topic string, partition int32, offset int64, epoch int32, version int32) error {
+	node := g.node("/offsets/%s/%d", topic, partition)
+	data := []byte(strconv.FormatInt(offset, 10))
+
+	var write interface{}
+	if version >= 0 {
+		write = &zk.SetDataRequest{Path: node, Data: data, Version: version}
+	} else if exists, _, err := g.conn.Exists(node); err != nil {
+		return err
+	} else if exists {
+		write = &zk.SetDataRequest{Path: node, Data: data, Version: -1}
+	} else {
+		if err := g.mkdirRecursive(path.Dir(node)); err != nil {
+			return err
+		}
+		write = &zk.CreateRequest{Path: node, Data: data, Acl: zk.WorldACL(zk.PermAll)}
+	}
+
+	var responses []zk.MultiResponse
+	var err error
+	if epoch < 0 {
+		responses, err = g.conn.Multi(write)
+	} else {
+		responses, err = g.conn.Multi(&zk.CheckVersionRequest{Path: g.node("/epochs/%s/%d", topic, partition), Version: epoch}, write)
+	}
+
+	if err == zk.ErrBadVersion {
+		// The result of every operation tells which of the versions did not match.
+		if version >= 0 && len(responses) > 0 && responses[len(responses)-1].Error == zk.ErrBadVersion {
+			return offsetChanged
+		}
+		return ErrPartitionFenced
+	}
+	return err
+}
+
+func (g *zookeeperGroup) FetchOffset(topic string, partition int32) (int64, error) {
+	offset, _, err := g.FetchOffsetVersion(topic, partition)
+	return offset, err
+}
+
+// FetchOffsetVersion returns the stored offset and the version of its node, or -1 and -1
+// if no offset is stored.
+func (g *zookeeperGroup) FetchOffsetVersion(topic string, partition int32) (int64, int32, error) {
+	val, stat, err := g.conn.Get(g.node("/offsets/%s/%d", topic, partition))
+	if err == zk.ErrNoNode {
+		return -1, -1, nil
+	} else if err != nil {
+		return -1, -1, err
+	}
+	offset, err := strconv.ParseInt(string(val), 10, 64)
+	return offset, stat.Version, err
+}
+
+// PartitionEpoch returns the epoch of the latest claim on a partition, as used by
+// CommitOffset. The epoch node is created if the partition was never claimed.
+func (g *zookeeperGroup) PartitionEpoch(topic string, partition int32) (int32, error) {
+	node := g.node("/epochs/%s/%d", topic, partition)
+	if err := g.create(node, nil, false); err != nil && err != zk.ErrNodeExists {
+		return -1, err
+	}
+	_, stat, err := g.conn.Get(node)
+	if err != nil {
+		return -1, err
+	}
+	return stat.Version, nil
+}
+
+// attemptCounter is stored in the attempts node of a partition.
+type attemptCounter struct {
+	Offset   int64 `json:"offset"`
+	Attempts int   `json:"attempts"`
+	Located  bool  `json:"located,omitempty"` // Whether the attempts moved the offset forward with every processed message.
+	Reached  int64 `json:"reached"`           // The highest offset the current attempt received, or -1 if it is not known.
+}
+
+// RecordAttempt counts an attempt to consume the partition from offset, and returns the
+// number of consecutive attempts that were made from that offset. It also returns
+// whether the earlier attempts moved the offset forward with AdvanceAttempts, so that
+// they failed on the message at offset rather than on one after it, and the highest
+// offset the previous attempt received, or -1 if it is not known.
+func (g *zookeeperGroup) RecordAttempt(topic string, partition int32, offset int64) (int, bool, int64, error) {
+	node := g.node("/attempts/%s/%d", topic, partition)
+
+	counter := attemptCounter{Offset: offset, Attempts: 1, Reached: -1}
+	data, stat, err := g.conn.Get(node)
+	if err == zk.ErrNoNode {
+		data, err = json.Marshal(&counter)
+		if err != nil {
+			return 0, false, -1, err
+		}
+		return counter.Attempts, false, -1, g.create(node, data, false)
+	} else if err != nil {
+		return 0, false, -1, err
+	}
+
+	stored := attemptCounter{Reached: -1}
+	located, reached := false, int64(-1)
+	if err := json.Unmarshal(data, &stored); err == nil && stored.Offset == offset {
+		counter.Attempts = stored.Attempts + 1
+		located, reached = stored.Located, stored.Reached
+	}
+	// An attempt after one that did not end cleanly moves the offset forward.
+	counter.Located = counter.Attempts > 1
+
+	if data, err = json.Marshal(&counter); err != nil {
+		return 0, false, -1, err
+	}
+	_, err = g.conn.Set(node, data, stat.Version)
+	return counter.Attempts, located, reached, err
+}
+
+// AdvanceAttempts records that the current attempt to consume the partition processed
+// all messages before offset. Unless the attempt still moves the offset forward with
+// every processed message, the attempts after it are not located.
+func (g *zookeeperGroup) AdvanceAttempts(topic string, partition int32, offset int64, located bool) error {
+	return g.updateAttempts(topic, partition, func(counter *attemptCounter) {
+		counter.Offset, counter.Attempts, counter.Located = offset, 1, located
+	})
+}
+
+// RecordReached records the highest offset the current attempt to consume the partition
+// received.
+func (g *zookeeperGroup) RecordReached(topic string, partition int32, offset int64) error {
+	return g.updateAttempts(topic, partition, func(counter *attemptCounter) {
+		counter.Reached = offset
+	})
+}
+
+// updateAttempts changes the attempts node of a partition, if attempts are counted.
+func (g *zookeeperGroup) updateAttempts(topic string, partition int32, update func(*attemptCounter)) error {
+	node := g.node("/attempts/%s/%d", topic, partition)
+	data, stat, err := g.conn.Get(node)
+	if err == zk.ErrNoNode {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	counter := attemptCounter{Reached: -1}
+	if err := json.Unmarshal(data, &counter); err != nil {
+		return err
+	}
+	update(&counter)
+
+	if data, err = json.Marshal(&counter); err != nil {
+		return err
+	}
+	_, err = g.conn.Set(node, data, stat.Version)
+	return err
+}
+
+// ClearAttempts forgets the attempts to consume the partition.
+func (g *zookeeperGroup) ClearAttempts(topic string, partition int32) error {
+	if err := g.conn.Delete(g.node("/attempts/%s/%d", topic, partition), -1); err != nil && err != zk.ErrNoNode {
+		return err
+	}
+	return nil
+}
+
+// FetchEndOffset returns the end offset stored for a bounded partition, or -1 if no end
+// offset is stored.
+func (g *zookeeperGroup) FetchEndOffset(topic string, partition int32) (int64, error) {
+	val, _, err := g.conn.Get(g.node("/ends/%s/%d", topic, partition))
+	if err == zk.ErrNoNode {
+		return -1, nil
+	} else if err != nil {
+		return -1, err
+	}
+	return strconv.ParseInt(string(val), 10, 64)
+}
+
+// StoreEndOffset stores the end offset of a bounded partition unless one is stored
+// already, and returns the end offset that is stored.
+func (g *zookeeperGroup) StoreEndOffset(topic string, partition int32, offset int64) (int64, error) {
+	err := g.create(g.node("/ends/%s/%d", topic, partition), []byte(strconv.FormatInt(offset, 10)), false)
+	if err == zk.ErrNodeExists {
+		return g.FetchEndOffset(topic, partition)
+	} else if err != nil {
+		return -1, err
+	}
+	return offset, nil
+}
+
+// ClearEndOffsets forgets the end offsets of all bounded partitions.
+func (g *zookeeperGroup) ClearEndOffsets() error {
+	return g.deleteRecursive(g.node("/ends"))
+}
+
+// WatchInstances returns the registered instances, and a channel that receives an event
+// as soon as the list of instances changes.
+func (g *zookeeperGroup) WatchInstances() ([]*Member, <-chan zk.Event, error) {
+	node := g.node("/ids")
+	ids, _, c, err := g.conn.ChildrenW(node)
+	if err == zk.ErrNoNode {
+		if err = g.mkdirRecursive(node); err != nil {
+			return nil, nil, err
+		}
+		ids, _, c, err = g.conn.ChildrenW(node)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	members, err := g.members(ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	return members, c, nil
+}
+
+// Instances returns the registered instances.
+func (g *zookeeperGroup) Instances() ([]*Member, error) {
+	ids, _, err := g.conn.Children(g.node("/ids"))
+	if err == zk.ErrNoNode {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return g.members(ids)
+}
+
+// members reads the registrations of a list of instances. Instances that have gone away
+// in the meantime are left out. Instances with a registration that cannot be read are
+// kept without their metadata, so that all instances still divide the partitions the
+// same way.
+func (g *zookeeperGroup) members(ids []string) ([]*Member, error) {
+	result := make([]*Member, 0, len(ids))
+	for _, id := range ids {
+		data, _, err := g.conn.Get(g.node("/ids/%s", id))
+		if err == zk.ErrNoNode {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var registration instanceRegistration
+		if err := json.Unmarshal(data, &registration); err != nil {
+			sarama.Logger.Printf("[%s] Invalid registration of instance %s: %s\n", g.name, id, err)
+			registration = instanceRegistration{}
+		}
+		result = append(result, registration.member(id))
+	}
+	return result, nil
+}
+
+// PartitionOwners returns the IDs of the instances that have claimed partitions, by topic
+// and partition.
+func (g *zookeeperGroup) PartitionOwners() (map[string]map[int32]string, error) {
+	result := make(map[string]map[int32]string)
+
+	topics, _, err := g.conn.Children(g.node("/owners"))
+	if err == zk.ErrNoNode {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, topic := range topics {
+		partitions, _, err := g.conn.Children(g.node("/owners/%s", topic))
+		if err == zk.ErrNoNode {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, child := range partitions {
+			partition, err := strconv.ParseInt(child, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+
+			owner, _, err := g.conn.Get(g.node("/owners/%s/%s", topic, child))
+			if err == zk.ErrNoNode {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			if result[topic] == nil {
+				result[topic] = make(map[int32]string)
+			}
+			result[topic][int32(partition)] = string(owner)
+		}
+	}
+
+	return result, nil
+}
+
+// Volunteer adds the instance as a candidate for the leadership of the group, and
+// returns the path of its candidate node. Candidates are ephemeral sequential nodes, so
+// the leader is the oldest candidate whose session is still alive.
+func (g *zookeeperGroup) Volunteer(id string) (string, error) {
+	node := g.node("/leader")
+	if err := g.mkdirRecursive(node); err != nil {
+		return "", err
+	}
+	return g.conn.CreateProtectedEphemeralSequential(node+"/candidate-", []byte(id), zk.WorldACL(zk.PermAll))
+}
+
+// WatchCandidate reports whether the candidate leads the group, and returns a channel
+// that receives an event when that may have changed: when the candidate node goes away
+// if it leads, and when the candidate before it goes away otherwise. It returns
+// zk.ErrNoNode if the candidate node is gone, e.g. because its session expired.
+func (g *zookeeperGroup) WatchCandidate(candidate string) (bool, <-chan zk.Event, error) {
+	for {
+		candidates, err := g.candidates()
+		if err != nil {
+			return false, nil, err
+		}
+
+		i := slices.Index(candidates, path.Base(candidate))
+		if i < 0 {
+			return false, nil, zk.ErrNoNode
+		}
+
+		watched := candidate
+		if i > 0 {
+			watched = g.node("/leader/%s", candidates[i-1])
+		}
+		exists, _, c, err := g.conn.ExistsW(watched)
+		if err != nil {
+			return false, nil, err
+		} else if exists {
+			return i == 0, c, nil
+		}
+	}
+}
+
+// Withdraw removes a candidate from the leader election.
+func (g *zookeeperGroup) Withdraw(candidate string) error {
+	err := g.conn.Delete(candidate, -1)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	return err
+}
+
+// Leader returns the ID of the instance that leads the group, or "" if there are no
+// candidates.
+func (g *zookeeperGroup) Leader() (string, error) {
+	for {
+		candidates, err := g.candidates()
+		if err != nil || len(candidates) == 0 {
+			return "", err
+		}
+
+		data, _, err := g.conn.Get(g.node("/leader/%s", candidates[0]))
+		if err == zk.ErrNoNode {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
+// candidates returns the names of the candidate nodes in the order they were created.
+func (g *zookeeperGroup) candidates() ([]string, error) {
+	candidates, _, err := g.conn.Children(g.node("/leader"))
+	if err == zk.ErrNoNode {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// The protected prefix of the names is random, so sort by the sequence number only.
+	sort.Slice(candidates, func(i, j int) bool {
+		return sequenceNumber(candidates[i]) < sequenceNumber(candidates[j])
+	})
+	return candidates, nil
+}
+
+// sequenceNumber returns the counter Zookeeper appends to the name of a sequential node.
+func sequenceNumber(name string) string {
+	if len(name) < 10 {
+		return name
+	}
+	return name[len(name)-10:]
+}
+
+func (g *zookeeperGroup) Instance(id string, registration instanceRegistration) *zookeeperGroupInstance {
+	return &zookeeperGroupInstance{group: g, id: id, registration: registration}
+}
+
+func (g *zookeeperGroup) mkdirRecursive(node string) error {
+	if parent := path.Dir(node); parent != "/" {
+		if err := g.mkdirRecursive(parent); err != nil {
+			return err
+		}
+	}
+
+	_, err := g.conn.Create(node, nil, 0, zk.WorldACL(zk.PermAll))
+	if err == zk.ErrNodeExists {
+		return nil
+	}
+	return err
+}
+
+func (g *zookeeperGroup) deleteRecursive(node string) error {
+	children, stat, err := g.conn.Children(node)
+	if err == zk.ErrNoNode {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if err := g.deleteRecursive(path.Join(node, child)); err != nil {
+			return err
+		}
+	}
+
+	err = g.conn.Delete(node, stat.Version)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	return err
+}
+
+func (g *zookeeperGroup) create(node string, value []byte, ephemeral bool) error {
+	if err := g.mkdirRecursive(path.Dir(node)); err != nil {
+		return err
+	}
+
+	flags := int32(0)
+	if ephemeral {
+		flags = zk.FlagEphemeral
+	}
+	_, err := g.conn.Create(node, value, flags, zk.WorldACL(zk.PermAll))
+	return err
+}
+
+// instanceRegistration is stored in the registration node of an instance. It extends the
+// registration kazoo uses with the metadata of the instance.
+type instanceRegistration struct {
+	kazoo.Registration
+	Rack            string            `json:"rack,omitempty"`
+	Weight          int               `json:"weight,omitempty"`
+	InstanceVersion string            `json:"instance_version,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Standby         bool              `json:"standby,omitempty"`
+	ActiveInstances int               `json:"active_instances,omitempty"`
+	Hostname        string            `json:"hostname,omitempty"`
+	PID             int               `json:"pid,omitempty"`
+	StartTime       int64             `json:"start_time,omitempty"`
+}
+
+func (r *instanceRegistration) member(id string) *Member {
+	member := &Member{
+		ID:       id,
+		Rack:     r.Rack,
+		Weight:   r.Weight,
+		Version:  r.InstanceVersion,
+		Labels:   r.Labels,
+		Standby:  r.Standby,
+		Hostname: r.Hostname,
+		PID:      r.PID,
+
+		activeInstances: r.ActiveInstances,
+	}
+	for topic := range r.Subscription {
+		member.Topics = append(member.Topics, topic)
+	}
+	sort.Strings(member.Topics)
+	if r.StartTime > 0 {
+		member.StartTime = time.Unix(r.StartTime, 0)
+	}
+	return member
+}
+
+// zookeeperGroupInstance manages the registration and partition claims of a single
+// consumer group instance.
+type zookeeperGroupInstance struct {
+	group        *zookeeperGroup
+	id           string
+	registration instanceRegistration
+}
+
+func (i *zookeeperGroupInstance) Register(topics []string) error {
+	subscription := make(map[string]int)
+	for _, topic := range topics {
+		subscription[topic] = 1
+	}
+
+	registration := i.registration
+	registration.Registration = kazoo.Registration{
+		Pattern:      kazoo.RegPatternStatic,
+		Subscription: subscription,
+		Timestamp:    time.Now().Unix(),
+		Version:      kazoo.RegDefaultVersion,
+	}
+
+	data, err := json.Marshal(&registration)
+	if err != nil {
+		return err
+	}
+
+	err = i.group.create(i.group.node("/ids/%s", i.id), data, true)
+	if err == zk.ErrNodeExists {
+		return kazoo.ErrInstanceAlreadyRegistered
+	}
+	return err
+}
+
+func (i *zookeeperGroupInstance) Registered() (bool, error) {
+	exists, _, err := i.group.conn.Exists(i.group.node("/ids/%s", i.id))
+	return exists, err
+}
+
+func (i *zookeeperGroupInstance) Deregister() error {
+	err := i.group.conn.Delete(i.group.node("/ids/%s", i.id), -1)
+	if err == zk.ErrNoNode {
+		return kazoo.ErrInstanceNotRegistered
+	}
+	return err
+}
+
+// ClaimPartition claims the partition for this instance, and returns the epoch of the
+// claim. The epoch is the version of a persistent node that is bumped on every claim,
+// so that offsets committed under an older claim can be rejected. The owner node is
+// created together with the bump, so that a claim that fails leaves no owner behind.
+func (i *zookeeperGroupInstance) ClaimPartition(topic string, partition int32) (int32, error) {
+	node := i.group.node("/owners/%s/%d", topic, partition)
+	epochNode := i.group.node("/epochs/%s/%d", topic, partition)
+	if err := i.group.create(epochNode, nil, false); err != nil && err != zk.ErrNodeExists {
+		return -1, err
+	}
+	if err := i.group.mkdirRecursive(path.Dir(node)); err != nil {
+		return -1, err
+	}
+
+	responses, err := i.group.conn.Multi(
+		&zk.CreateRequest{Path: node, Data: []byte(i.id), Acl: zk.WorldACL(zk.PermAll), Flags: zk.FlagEphemeral},
+		&zk.SetDataRequest{Path: epochNode, Data: []byte(i.id), Version: -1},
+	)
+	if err == nil {
+		return responses[1].Stat.Version, nil
+	} else if len(responses) == 0 || responses[0].Error != zk.ErrNodeExists {
+		return -1, err
+	}
+
+	// The partition is owned already, which is fine if this instance owns it.
+	data, _, err := i.group.conn.Get(node)
+	if err != nil {
+		return -1, err
+	}
+	if string(data) != i.id {
+		return -1, kazoo.ErrPartitionClaimedByOther
+	}
+	stat, err := i.group.conn.Set(epochNode, []byte(i.id), -1)
+	if err != nil {
+		return -1, err
+	}
+	return stat.Version, nil
+}
+
+func (i *zookeeperGroupInstance) ReleasePartition(topic string, partition int32) error {
+	node := i.group.node("/owners/%s/%d", topic, partition)
+	data, stat, err := i.group.conn.Get(node)
+	if err == zk.ErrNoNode || (err == nil && string(data) != i.id) {
+		return kazoo.ErrPartitionNotClaimed
+	} else if err != nil {
+		return err
+	}
+
+	return i.group.conn.Delete(node, stat.Version)
+}
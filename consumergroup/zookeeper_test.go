@@ -0,0 +1,672 @@
+package consumergroup
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/wvanbergen/kazoo-go"
+)
+
+type fakeNode struct {
+	data      []byte
+	version   int32
+	ephemeral bool
+}
+
+// fakeConn is an in-memory Zookeeper with a single session.
+type fakeConn struct {
+	l        sync.Mutex
+	nodes    map[string]*fakeNode
+	watches  map[string][]chan zk.Event
+	sequence int
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{nodes: make(map[string]*fakeNode), watches: make(map[string][]chan zk.Event)}
+}
+
+// expire ends the session: ephemeral nodes are removed, and watches are closed after
+// receiving ErrSessionExpired, the way *zk.Conn does.
+func (c *fakeConn) expire() {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	for node, n := range c.nodes {
+		if n.ephemeral {
+			delete(c.nodes, node)
+		}
+	}
+	for key, watches := range c.watches {
+		for _, w := range watches {
+			w <- zk.Event{Type: zk.EventNotWatching, State: zk.StateDisconnected, Path: key, Err: zk.ErrSessionExpired}
+			close(w)
+		}
+	}
+	c.watches = make(map[string][]chan zk.Event)
+}
+
+func (c *fakeConn) watch(key string) <-chan zk.Event {
+	w := make(chan zk.Event, 1)
+	c.watches[key] = append(c.watches[key], w)
+	return w
+}
+
+func (c *fakeConn) fire(key string, event zk.Event) {
+	for _, w := range c.watches[key] {
+		w <- event
+		close(w)
+	}
+	delete(c.watches, key)
+}
+
+func (c *fakeConn) children(node string) []string {
+	var result []string
+	for candidate := range c.nodes {
+		if path.Dir(candidate) == node && candidate != node {
+			result = append(result, path.Base(candidate))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (c *fakeConn) Children(node string) ([]string, *zk.Stat, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	n, ok := c.nodes[node]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return c.children(node), &zk.Stat{Version: n.version}, nil
+}
+
+func (c *fakeConn) ChildrenW(node string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	n, ok := c.nodes[node]
+	if !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	return c.children(node), &zk.Stat{Version: n.version}, c.watch("children:" + node), nil
+}
+
+func (c *fakeConn) Create(node string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	return node, c.create(node, data, flags)
+}
+
+func (c *fakeConn) create(node string, data []byte, flags int32) error {
+	if _, ok := c.nodes[node]; ok {
+		return zk.ErrNodeExists
+	}
+	parent := path.Dir(node)
+	if _, ok := c.nodes[parent]; !ok && parent != "/" {
+		return zk.ErrNoNode
+	}
+
+	c.nodes[node] = &fakeNode{data: data, ephemeral: flags&zk.FlagEphemeral != 0}
+	c.fire(node, zk.Event{Type: zk.EventNodeCreated, State: zk.StateHasSession, Path: node})
+	c.fire("children:"+parent, zk.Event{Type: zk.EventNodeChildrenChanged, State: zk.StateHasSession, Path: parent})
+	return nil
+}
+
+func (c *fakeConn) CreateProtectedEphemeralSequential(node string, data []byte, acl []zk.ACL) (string, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.sequence++
+	name := fmt.Sprintf("%s/_c_%032d-%s%010d", path.Dir(node), c.sequence, path.Base(node), c.sequence)
+	return name, c.create(name, data, zk.FlagEphemeral)
+}
+
+func (c *fakeConn) Delete(node string, version int32) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	n, ok := c.nodes[node]
+	if !ok {
+		return zk.ErrNoNode
+	} else if version >= 0 && version != n.version {
+		return zk.ErrBadVersion
+	} else if len(c.children(node)) > 0 {
+		return zk.ErrNotEmpty
+	}
+
+	delete(c.nodes, node)
+	c.fire(node, zk.Event{Type: zk.EventNodeDeleted, State: zk.StateHasSession, Path: node})
+	c.fire("children:"+path.Dir(node), zk.Event{Type: zk.EventNodeChildrenChanged, State: zk.StateHasSession, Path: path.Dir(node)})
+	return nil
+}
+
+func (c *fakeConn) Exists(node string) (bool, *zk.Stat, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if n, ok := c.nodes[node]; ok {
+		return true, &zk.Stat{Version: n.version}, nil
+	}
+	return false, nil, nil
+}
+
+func (c *fakeConn) ExistsW(node string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if n, ok := c.nodes[node]; ok {
+		return true, &zk.Stat{Version: n.version}, c.watch(node), nil
+	}
+	return false, nil, c.watch(node), nil
+}
+
+func (c *fakeConn) Get(node string) ([]byte, *zk.Stat, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	n, ok := c.nodes[node]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return n.data, &zk.Stat{Version: n.version}, nil
+}
+
+func (c *fakeConn) Set(node string, data []byte, version int32) (*zk.Stat, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	return c.set(node, data, version)
+}
+
+func (c *fakeConn) set(node string, data []byte, version int32) (*zk.Stat, error) {
+	n, ok := c.nodes[node]
+	if !ok {
+		return nil, zk.ErrNoNode
+	} else if version >= 0 && version != n.version {
+		return nil, zk.ErrBadVersion
+	}
+	n.data = data
+	n.version++
+	return &zk.Stat{Version: n.version}, nil
+}
+
+// Multi checks the versions first, so that a failed check leaves all nodes unchanged. Like
+// Zookeeper, it reports the error of the failed operation in its response too.
+func (c *fakeConn) Multi(ops ...interface{}) ([]zk.MultiResponse, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	responses := make([]zk.MultiResponse, len(ops))
+	for i, op := range ops {
+		var err error
+		switch op := op.(type) {
+		case *zk.CheckVersionRequest:
+			if n, ok := c.nodes[op.Path]; !ok {
+				err = zk.ErrNoNode
+			} else if op.Version >= 0 && op.Version != n.version {
+				err = zk.ErrBadVersion
+			}
+		case *zk.SetDataRequest:
+			if n, ok := c.nodes[op.Path]; !ok {
+				err = zk.ErrNoNode
+			} else if op.Version >= 0 && op.Version != n.version {
+				err = zk.ErrBadVersion
+			}
+		case *zk.CreateRequest:
+			if _, ok := c.nodes[op.Path]; ok {
+				err = zk.ErrNodeExists
+			} else if _, ok := c.nodes[path.Dir(op.Path)]; !ok {
+				err = zk.ErrNoNode
+			}
+		default:
+			return nil, fmt.Errorf("unsupported operation %T", op)
+		}
+		if err != nil {
+			responses[i].Error = err
+			return responses, err
+		}
+	}
+
+	for i, op := range ops {
+		switch op := op.(type) {
+		case *zk.SetDataRequest:
+			stat, err := c.set(op.Path, op.Data, op.Version)
+			if err != nil {
+				return nil, err
+			}
+			responses[i].Stat = stat
+		case *zk.CreateRequest:
+			if err := c.create(op.Path, op.Data, op.Flags); err != nil {
+				return nil, err
+			}
+			responses[i].String = op.Path
+		}
+	}
+	return responses, nil
+}
+
+func TestZookeeperGroupRegistration(t *testing.T) {
+	group := newZookeeperGroup(newFakeConn(), "", "RegistrationGroup")
+	instance := group.Instance("instance-a", instanceRegistration{Rack: "rack-a", Weight: 2, Hostname: "host-a", PID: 42})
+
+	if err := instance.Register([]string{"Topic"}); err != nil {
+		t.Fatal(err)
+	}
+	if registered, err := instance.Registered(); err != nil || !registered {
+		t.Errorf("Expected the instance to be registered, got %v, %v", registered, err)
+	}
+	if err := group.Instance("instance-a", instanceRegistration{}).Register([]string{"Topic"}); err != kazoo.ErrInstanceAlreadyRegistered {
+		t.Errorf("Expected ErrInstanceAlreadyRegistered, got %v", err)
+	}
+
+	members, err := group.Instances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 {
+		t.Fatalf("Expected 1 instance, got %d", len(members))
+	}
+	member := members[0]
+	if member.ID != "instance-a" || member.Rack != "rack-a" || member.Weight != 2 || member.Hostname != "host-a" || member.PID != 42 {
+		t.Errorf("Unexpected registration: %+v", member)
+	}
+	if len(member.Topics) != 1 || member.Topics[0] != "Topic" {
+		t.Errorf("Expected the registration to subscribe to Topic, got %v", member.Topics)
+	}
+
+	if err := instance.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+	if registered, _ := instance.Registered(); registered {
+		t.Error("Expected the instance to be deregistered")
+	}
+	if err := instance.Deregister(); err != kazoo.ErrInstanceNotRegistered {
+		t.Errorf("Expected ErrInstanceNotRegistered, got %v", err)
+	}
+}
+
+func TestZookeeperGroupClaims(t *testing.T) {
+	group := newZookeeperGroup(newFakeConn(), "", "ClaimGroup")
+	a := group.Instance("instance-a", instanceRegistration{})
+	b := group.Instance("instance-b", instanceRegistration{})
+
+	if epoch, err := a.ClaimPartition("Topic", 0); err != nil || epoch != 1 {
+		t.Fatalf("Expected the first claim to have epoch 1, got %d, %v", epoch, err)
+	}
+	if _, err := b.ClaimPartition("Topic", 0); err != kazoo.ErrPartitionClaimedByOther {
+		t.Errorf("Expected ErrPartitionClaimedByOther, got %v", err)
+	}
+	if err := b.ReleasePartition("Topic", 0); err != kazoo.ErrPartitionNotClaimed {
+		t.Errorf("Expected ErrPartitionNotClaimed, got %v", err)
+	}
+
+	owners, err := group.PartitionOwners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owners["Topic"][0] != "instance-a" {
+		t.Errorf("Expected instance-a to own the partition, got %v", owners)
+	}
+
+	if err := group.CommitOffset("Topic", 0, 10, 1, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReleasePartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if epoch, err := b.ClaimPartition("Topic", 0); err != nil || epoch != 2 {
+		t.Fatalf("Expected the second claim to have epoch 2, got %d, %v", epoch, err)
+	}
+	if epoch, err := b.ClaimPartition("Topic", 0); err != nil || epoch != 3 {
+		t.Errorf("Expected claiming an owned partition again to have epoch 3, got %d, %v", epoch, err)
+	}
+	if err := group.CommitOffset("Topic", 0, 20, 1, -1); err != ErrPartitionFenced {
+		t.Errorf("Expected a commit under the old claim to be fenced, got %v", err)
+	}
+	if err := group.CommitOffset("Topic", 0, 30, 3, -1); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := group.FetchOffset("Topic", 0); err != nil || offset != 30 {
+		t.Errorf("Expected offset 30, got %d, %v", offset, err)
+	}
+	if offset, err := group.FetchOffset("Topic", 1); err != nil || offset != -1 {
+		t.Errorf("Expected offset -1 for a partition without commits, got %d, %v", offset, err)
+	}
+}
+
+// epochFailingConn fails every multi operation that bumps the epoch of a partition.
+type epochFailingConn struct {
+	*fakeConn
+}
+
+func (c *epochFailingConn) Multi(ops ...interface{}) ([]zk.MultiResponse, error) {
+	for i, op := range ops {
+		if set, ok := op.(*zk.SetDataRequest); ok && path.Base(path.Dir(path.Dir(set.Path))) == "epochs" {
+			responses := make([]zk.MultiResponse, len(ops))
+			responses[i].Error = zk.ErrConnectionClosed
+			return responses, zk.ErrConnectionClosed
+		}
+	}
+	return c.fakeConn.Multi(ops...)
+}
+
+func TestZookeeperGroupFailedClaimLeavesNoOwner(t *testing.T) {
+	group := newZookeeperGroup(&epochFailingConn{fakeConn: newFakeConn()}, "", "ClaimGroup")
+	if _, err := group.Instance("instance-a", instanceRegistration{}).ClaimPartition("Topic", 0); err != zk.ErrConnectionClosed {
+		t.Errorf("Expected the claim to fail, got %v", err)
+	}
+	if owners, err := group.PartitionOwners(); err != nil || len(owners["Topic"]) != 0 {
+		t.Errorf("Expected the failed claim to leave no owner, got %v, %v", owners, err)
+	}
+}
+
+func TestZookeeperGroupSessionExpiry(t *testing.T) {
+	conn := newFakeConn()
+	group := newZookeeperGroup(conn, "", "ExpiryGroup")
+	instance := group.Instance("instance-a", instanceRegistration{})
+
+	if err := instance.Register([]string{"Topic"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.ClaimPartition("Topic", 0); err != nil {
+		t.Fatal(err)
+	}
+	_, changes, err := group.WatchInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.expire()
+
+	if event := <-changes; event.Err != zk.ErrSessionExpired {
+		t.Errorf("Expected the watch to report the expired session, got %v", event)
+	}
+	if registered, _ := instance.Registered(); registered {
+		t.Error("Expected the registration to be gone with the session")
+	}
+	if owners, _ := group.PartitionOwners(); len(owners["Topic"]) != 0 {
+		t.Errorf("Expected the claims to be gone with the session, got %v", owners)
+	}
+
+	if err := instance.Register([]string{"Topic"}); err != nil {
+		t.Fatal(err)
+	}
+	if epoch, err := instance.ClaimPartition("Topic", 0); err != nil || epoch != 2 {
+		t.Errorf("Expected the claim after the expiry to have epoch 2, got %d, %v", epoch, err)
+	}
+}
+
+type idleConsumer struct {
+	mockSaramaConsumer
+}
+
+func (c *idleConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	return &boundedPartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage),
+		errors:   make(chan *sarama.ConsumerError),
+	}, nil
+}
+
+type partitionTopicReader struct {
+	mockZookeeperTopicReader
+}
+
+func (tr *partitionTopicReader) TopicPartitions(topic string) (kazoo.PartitionList, error) {
+	return nil, nil
+}
+
+func TestSessionExpiryReregistersAndClaimsAgain(t *testing.T) {
+	conn := newFakeConn()
+	group := newZookeeperGroup(conn, "", "SessionGroup")
+	session := make(chan zk.Event, 4)
+
+	consumer, err := JoinConsumerGroup(
+		"SessionGroup",
+		[]string{"Topic"},
+		[]string{"localhost:2181"},
+		nil,
+		func(name string, topics []string, zookeeper []string, config *Config) (*ConsumerGroup, error) {
+			cg, err := newMockConsumerGroup(name, topics, zookeeper, config)
+			if err != nil {
+				return nil, err
+			}
+			cg.consumer = &idleConsumer{}
+			cg.kazoo = &partitionTopicReader{}
+			cg.group = group
+			cg.instance = group.Instance(cg.instanceID, instanceRegistration{})
+			if err := cg.instance.Register(topics); err != nil {
+				return nil, err
+			}
+			go cg.watchSession(session)
+			return cg, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+
+	waitForEpoch := func(epoch int32) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for consumer.claimEpoch("Topic", 0) != epoch {
+			select {
+			case <-deadline:
+				t.Fatalf("Expected the partition to be claimed with epoch %d, got %d", epoch, consumer.claimEpoch("Topic", 0))
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	session <- zk.Event{Type: zk.EventSession, State: zk.StateHasSession, Server: "localhost:2181"}
+	if event := <-consumer.SessionEvents(); event != (SessionEvent{State: SessionConnected, Server: "localhost:2181"}) {
+		t.Errorf("Expected a connected event, got %+v", event)
+	}
+	waitForEpoch(1)
+
+	conn.expire()
+	session <- zk.Event{Type: zk.EventSession, State: zk.StateExpired}
+	if event := <-consumer.SessionEvents(); event.State != SessionLost {
+		t.Errorf("Expected a lost session event, got %+v", event)
+	}
+
+	waitForEpoch(2)
+	if registered, err := consumer.instance.Registered(); err != nil || !registered {
+		t.Errorf("Expected the instance to register again, got %v, %v", registered, err)
+	}
+	if owners, _ := group.PartitionOwners(); owners["Topic"][0] != consumer.instanceID {
+		t.Errorf("Expected the instance to claim the partition again, got %v", owners)
+	}
+}
+
+// singleMessageConsumer delivers a single message every time a partition is consumed.
+type singleMessageConsumer struct {
+	mockSaramaConsumer
+}
+
+func (c *singleMessageConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	pc := &boundedPartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage, 1),
+		errors:   make(chan *sarama.ConsumerError),
+	}
+	pc.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: max(offset, 0)}
+	return pc, nil
+}
+
+func TestSessionExpiryDuringRebalanceReregisters(t *testing.T) {
+	conn := newFakeConn()
+	group := newZookeeperGroup(conn, "", "SessionGroup")
+	session := make(chan zk.Event, 4)
+
+	config := NewConfig()
+	config.Offsets.ProcessingTimeout = 200 * time.Millisecond
+	consumer, err := JoinConsumerGroup(
+		"SessionGroup",
+		[]string{"Topic"},
+		[]string{"localhost:2181"},
+		config,
+		func(name string, topics []string, zookeeper []string, config *Config) (*ConsumerGroup, error) {
+			cg, err := newMockConsumerGroup(name, topics, zookeeper, config)
+			if err != nil {
+				return nil, err
+			}
+			cg.consumer = &singleMessageConsumer{}
+			cg.kazoo = &partitionTopicReader{}
+			cg.group = group
+			cg.instance = group.Instance(cg.instanceID, instanceRegistration{})
+			if err := cg.instance.Register(topics); err != nil {
+				return nil, err
+			}
+			go cg.watchSession(session)
+			return cg, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+
+	// The message is never processed, so the rebalance below waits ProcessingTimeout for
+	// the partition consumer.
+	select {
+	case <-consumer.Messages():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for a message")
+	}
+
+	if err := group.Instance("instance-b", instanceRegistration{}).Register([]string{"Topic"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The session expires while the rebalance waits, which also removes instance-b.
+	conn.expire()
+	session <- zk.Event{Type: zk.EventSession, State: zk.StateExpired}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		registered, _ := consumer.instance.Registered()
+		owners, _ := group.PartitionOwners()
+		if registered && owners["Topic"][0] == consumer.instanceID {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("Expected the instance to register again and claim the partition, got %v, %v", registered, owners)
+		case <-consumer.Messages():
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestSessionEventsDropWhenFull(t *testing.T) {
+	cg := &ConsumerGroup{
+		config:         NewConfig(),
+		sessionEvents:  make(chan SessionEvent, 1),
+		sessionExpired: make(chan struct{}, 1),
+	}
+
+	events := make(chan zk.Event, 3)
+	events <- zk.Event{Type: zk.EventSession, State: zk.StateDisconnected}
+	events <- zk.Event{Type: zk.EventSession, State: zk.StateHasSession, Server: "zk1"}
+	events <- zk.Event{Type: zk.EventNodeCreated, Path: "/ignored"}
+	close(events)
+	cg.watchSession(events)
+
+	var received []SessionEvent
+	for event := range cg.SessionEvents() {
+		received = append(received, event)
+	}
+	if len(received) != 1 || received[0].State != SessionDisconnected {
+		t.Errorf("Expected only the first event to be kept, got %+v", received)
+	}
+}
+
+func TestZookeeperGroupKeepsInvalidRegistrations(t *testing.T) {
+	conn := newFakeConn()
+	group := newZookeeperGroup(conn, "", "InvalidGroup")
+	if err := group.Instance("instance-a", instanceRegistration{Weight: 2}).Register([]string{"Topic"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.create(group.node("/ids/instance-b"), []byte("{not json"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	members, _, err := group.WatchInstances()
+	if err != nil {
+		t.Fatalf("Expected an invalid registration not to fail the watch, got %v", err)
+	}
+	if len(members) != 2 || members[0].Weight != 2 || members[1].ID != "instance-b" || members[1].Weight != 0 {
+		t.Errorf("Expected the invalid registration to be kept without metadata, got %+v, %+v", members[0], members[1])
+	}
+}
+
+func TestMembers(t *testing.T) {
+	group := newZookeeperGroup(newFakeConn(), "", "MembersGroup")
+	started := time.Unix(1500000000, 0)
+	b := group.Instance("instance-b", instanceRegistration{
+		Rack:            "rack-b",
+		Weight:          3,
+		InstanceVersion: "1.2.0",
+		Labels:          map[string]string{"role": "canary"},
+		Hostname:        "host-b",
+		PID:             7,
+		StartTime:       started.Unix(),
+	})
+	a := group.Instance("instance-a", instanceRegistration{Standby: true})
+	for _, instance := range []*zookeeperGroupInstance{b, a} {
+		if err := instance.Register([]string{"Other", "Topic"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, partition := range []int32{2, 0} {
+		if _, err := b.ClaimPartition("Topic", partition); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.ClaimPartition("Topic", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	cg, _ := newMockConsumerGroup("MembersGroup", []string{"Topic"}, nil, nil)
+	cg.group = group
+	members, err := cg.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*Member{
+		{
+			ID:      "instance-a",
+			Standby: true,
+			Topics:  []string{"Other", "Topic"},
+			Claims:  map[string][]int32{"Topic": {1}},
+		},
+		{
+			ID:        "instance-b",
+			Rack:      "rack-b",
+			Weight:    3,
+			Version:   "1.2.0",
+			Labels:    map[string]string{"role": "canary"},
+			Hostname:  "host-b",
+			PID:       7,
+			StartTime: started,
+			Topics:    []string{"Other", "Topic"},
+			Claims:    map[string][]int32{"Topic": {0, 2}},
+		},
+	}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("Unexpected members:")
+		for _, member := range members {
+			t.Errorf("  %+v", member)
+		}
+	}
+}
@@ -4,6 +4,7 @@ go 1.26
 
 require (
 	github.com/Shopify/sarama v1.23.0
+	github.com/rcrowley/go-metrics v0.0.0-20181016184325-3113b8401b8a
 	github.com/samuel/go-zookeeper v0.0.0-20201211165307-7117e9ea2414
 	github.com/wvanbergen/kazoo-go v0.0.0-20180202103751-f72d8611297a
 	golang.org/x/time v0.15.0
@@ -19,7 +20,6 @@ require (
 	github.com/hashicorp/go-uuid v1.0.1 // indirect
 	github.com/jcmturner/gofork v0.0.0-20190328161633-dc7c13fece03 // indirect
 	github.com/pierrec/lz4 v0.0.0-20190327172049-315a67e90e41 // indirect
-	github.com/rcrowley/go-metrics v0.0.0-20181016184325-3113b8401b8a // indirect
 	golang.org/x/crypto v0.54.0 // indirect
 	golang.org/x/net v0.57.0 // indirect
 	gopkg.in/jcmturner/aescts.v1 v1.0.1 // indirect